@@ -0,0 +1,145 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Returns true if the file is an archive we can look inside of with --archives
+func IsArchive(name string) bool {
+	name = strings.ToLower(name)
+	for _, extension := range []string{".tar", ".tar.gz", ".tgz", ".zip"} {
+		if strings.HasSuffix(name, extension) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the folder name is in, or an empty string for the top of the archive
+func parentDir(name string) string {
+	dir := path.Dir(name)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// Adds the files inside the archive as virtual children of it, like a folder
+// The archive itself is still counted as a file with its size on disk, the files inside it are not counted in the folders above it
+// The compressed size is used as the allocated size of the files inside it, which is the size with diskUsage
+func ReadArchive(archive *Node, archivePath string, diskUsage bool) error {
+	archive.archive = true
+	folders := map[string]*Node{"": archive}
+
+	// Returns the virtual folder, creating it and the folders above it if needed
+	var folderOf func(dir string) *Node
+	folderOf = func(dir string) *Node {
+		if folder, ok := folders[dir]; ok {
+			return folder
+		}
+
+		parent := folderOf(parentDir(dir))
+		folder := &Node{name: path.Base(dir), parent: parent, isDir: true, virtual: true, mtime: archive.mtime, uid: archive.uid}
+		parent.children = append(parent.children, folder)
+		folders[dir] = folder
+		return folder
+	}
+
+	// Cleans up names like "./a/b" and "../../etc/passwd", returns an empty string for the archive itself
+	cleanName := func(name string) string {
+		return strings.TrimPrefix(path.Clean("/"+name), "/")
+	}
+
+	addFile := func(name string, uncompressed, compressed int64, modTime time.Time, uid uint32) {
+		name = cleanName(name)
+		if name == "" {
+			return
+		}
+
+		size := uncompressed
+		if diskUsage {
+			size = compressed
+		}
+
+		parent := folderOf(parentDir(name))
+		parent.children = append(parent.children, &Node{
+			name:          path.Base(name),
+			parent:        parent,
+			ownSize:       size,
+			totalSize:     size,
+			apparentSize:  uncompressed,
+			allocatedSize: compressed,
+			mtime:         modTime.Unix(),
+			atime:         modTime.Unix(),
+			ctime:         modTime.Unix(),
+			uid:           uid,
+			linkCount:     1,
+			virtual:       true,
+		})
+	}
+
+	addFolder := func(name string) {
+		if name = cleanName(name); name != "" {
+			folderOf(name)
+		}
+	}
+
+	if strings.HasSuffix(strings.ToLower(archivePath), ".zip") {
+		reader, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		for _, file := range reader.File {
+			if file.FileInfo().IsDir() {
+				addFolder(file.Name)
+			} else if file.FileInfo().Mode().IsRegular() {
+				addFile(file.Name, int64(file.UncompressedSize64), int64(file.CompressedSize64), file.Modified, archive.uid)
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if !strings.HasSuffix(strings.ToLower(archivePath), ".tar") {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	// The compressed size of each file in a tar.gz is unknown, so it's the same as the uncompressed size
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			addFolder(header.Name)
+		case tar.TypeReg:
+			addFile(header.Name, header.Size, header.Size, header.ModTime, uint32(header.Uid))
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// How sizes are written in the text, csv and tsv formats, parsed from --block-size like coreutils
+// https://www.gnu.org/software/coreutils/manual/html_node/Block-size.html
+type BlockSize struct {
+	human     bool       // The unit is picked for each size, like du -h
+	units     UnitSystem // Only used for human
+	precision int        // Only used for human, the max amount of decimals
+	size      int64      // Sizes are divided by this and rounded up, like du
+	suffix    string     // Written after every size, like "K" for --block-size=K
+}
+
+var blockSizeUnits = []string{"K", "M", "G", "T", "P", "E"} // Largest unit that fits in 64 bits
+
+// Parses a block size like "1", "K", "4k", "MB", "1MiB", "human-readable", "si" or "raw"
+// Like coreutils, the unit is only written after the sizes when there is no number before it
+func ParseBlockSize(str string) (BlockSize, error) {
+	switch str {
+	case "human-readable", "iec":
+		return BlockSize{human: true, units: IEC}, nil
+	case "si":
+		return BlockSize{human: true, units: SI}, nil
+	case "raw":
+		return BlockSize{size: 1}, nil
+	}
+
+	numberEnd := 0
+	for numberEnd < len(str) && str[numberEnd] >= '0' && str[numberEnd] <= '9' {
+		numberEnd++
+	}
+
+	number := int64(1)
+	if numberEnd > 0 {
+		var err error
+		number, err = strconv.ParseInt(str[:numberEnd], 10, 64)
+		if err != nil || number <= 0 {
+			return BlockSize{}, errors.New("Invalid --block-size \"" + str + "\"")
+		}
+	}
+
+	unit := str[numberEnd:]
+	if unit == "" {
+		if numberEnd == 0 {
+			return BlockSize{}, errors.New("Invalid --block-size \"" + str + "\"")
+		}
+		return BlockSize{size: number}, nil
+	}
+
+	base := int64(1024)
+	unitLetter := strings.ToUpper(unit[:1])
+	switch unit[1:] {
+	case "", "iB":
+	case "B":
+		base = 1000
+	default:
+		return BlockSize{}, errors.New("Invalid --block-size \"" + str + "\", unknown unit \"" + unit + "\"")
+	}
+
+	unitSize := int64(1)
+	for i, u := range blockSizeUnits {
+		unitSize *= base
+		if u == unitLetter {
+			break
+		}
+
+		if i == len(blockSizeUnits)-1 {
+			return BlockSize{}, errors.New("Invalid --block-size \"" + str + "\", unknown unit \"" + unit + "\"")
+		}
+	}
+
+	if number > (1<<63-1)/unitSize {
+		return BlockSize{}, errors.New("Invalid --block-size \"" + str + "\", too large")
+	}
+
+	blockSize := BlockSize{size: number * unitSize}
+	if numberEnd == 0 {
+		blockSize.suffix = unit
+	}
+	return blockSize, nil
+}
+
+func (blockSize BlockSize) Format(bytes int64) string {
+	if blockSize.human {
+		return BytesToHumanReadableUnitString(uint64(max(0, bytes)), blockSize.units, blockSize.precision)
+	}
+
+	// Rounded up, so small files aren't shown as 0
+	blocks := bytes / blockSize.size
+	if bytes%blockSize.size > 0 {
+		blocks++
+	}
+	return strconv.FormatInt(blocks, 10) + blockSize.suffix
+}
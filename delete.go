@@ -0,0 +1,227 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Marks or unmarks the selected row in the Files or Folders tab for deletion
+func (fssize *FSSize) ToggleMark() {
+	if fssize.currentTab != Files && fssize.currentTab != Folders {
+		return
+	}
+
+	list := fssize.CurrentList()
+	selected := fssize.selected[fssize.currentTab]
+	if selected >= len(list) {
+		return
+	}
+
+	file := list[selected]
+	if file.path == fssize.rootFolderPath || file.virtual {
+		return
+	}
+
+	if _, ok := fssize.marked[file.path]; ok {
+		delete(fssize.marked, file.path)
+	} else {
+		fssize.marked[file.path] = file
+	}
+}
+
+// Returns the marked files and folders, leaving out the ones inside a marked folder since they will be deleted along with it
+func (fssize *FSSize) MarkedFiles() []File {
+	var ret []File
+	for path, file := range fssize.marked {
+		insideMarkedFolder := false
+		for otherPath := range fssize.marked {
+			if otherPath != path && IsSubPath(otherPath, path) {
+				insideMarkedFolder = true
+				break
+			}
+		}
+
+		if !insideMarkedFolder {
+			ret = append(ret, file)
+		}
+	}
+
+	fssize.SortFiles(&ret)
+	return ret
+}
+
+// Returns the marked files and folders, or the selected one if none are marked
+func (fssize *FSSize) MarkedOrSelectedFiles() []File {
+	ret := fssize.MarkedFiles()
+	if len(ret) > 0 {
+		return ret
+	}
+
+	list := fssize.CurrentList()
+	selected := fssize.selected[fssize.currentTab]
+	if selected >= len(list) || list[selected].path == fssize.rootFolderPath || list[selected].virtual {
+		return nil
+	}
+	return []File{list[selected]}
+}
+
+// Asks for confirmation before deleting the marked files and folders, or the selected one if none are marked
+// If toTrash is true, they are moved to the trash instead of being permanently deleted
+func (fssize *FSSize) ConfirmDelete(toTrash bool) {
+	if fssize.currentTab != Files && fssize.currentTab != Folders {
+		return
+	}
+
+	if fssize.accumulating {
+		fssize.ShowDialog("Wait for the search to finish before deleting", []string{"OK"}, nil)
+		return
+	}
+
+	if fssize.deletingPath != "" {
+		fssize.ShowDialog("Wait for "+fssize.deletingPath+" to be deleted", []string{"OK"}, nil)
+		return
+	}
+
+	toDelete := fssize.MarkedOrSelectedFiles()
+	if len(toDelete) == 0 {
+		return
+	}
+
+	var totalBytes int64
+	for _, file := range toDelete {
+		totalBytes += file.sizeBytes
+	}
+
+	verb := "Permanently delete"
+	button := "Delete"
+	if toTrash {
+		verb = "Move to trash"
+		button = "Trash"
+	}
+
+	var text string
+	if len(toDelete) == 1 {
+		text = verb + " " + toDelete[0].path + "?"
+	} else {
+		text = verb + " " + strconv.Itoa(len(toDelete)) + " files and folders?"
+	}
+	text += "\n\nThis will free up " + fssize.FormatBytes(totalBytes) + " (" + strconv.FormatInt(totalBytes, 10) + " bytes)"
+	if toTrash {
+		text += " once the trash is emptied"
+	}
+
+	fssize.ShowDialog(text, []string{"Cancel", button}, func(label string) {
+		if label == button {
+			fssize.DeleteFiles(toDelete, toTrash)
+		}
+	})
+}
+
+// Deletes or trashes the files and folders in the background, since a big folder can take a while
+// Once finished, they are removed from the results and a dialog lists the ones that failed
+// Expects the mutex to be locked
+func (fssize *FSSize) DeleteFiles(files []File, toTrash bool) {
+	fssize.deletingPath = files[0].path
+
+	go func() {
+		var deleted, failed []string
+		for _, file := range files {
+			fssize.mutex.Lock()
+			fssize.deletingPath = file.path
+			fssize.mutex.Unlock()
+			fssize.NotifyChanged()
+
+			var err error
+			if toTrash {
+				err = MoveToTrash(file.path)
+			} else if file.isDir {
+				err = os.RemoveAll(file.path)
+			} else {
+				err = os.Remove(file.path)
+			}
+
+			if err != nil {
+				failed = append(failed, err.Error())
+				continue
+			}
+			deleted = append(deleted, file.path)
+		}
+
+		// The dialog can only be shown from the UI goroutine
+		fssize.app.QueueUpdateDraw(func() {
+			fssize.mutex.Lock()
+			defer fssize.mutex.Unlock()
+
+			fssize.deletingPath = ""
+			for _, path := range deleted {
+				fssize.RemoveFromResults(path)
+			}
+
+			if toTrash {
+				fssize.LoadTrash()
+			}
+
+			fssize.ShowErrors(failed, len(files))
+		})
+	}()
+}
+
+// Shows a dialog listing the errors, if there are any
+func (fssize *FSSize) ShowErrors(failed []string, total int) {
+	if len(failed) == 0 {
+		return
+	}
+
+	text := "Failed " + strconv.Itoa(len(failed)) + " of " + strconv.Itoa(total) + ":\n\n"
+	const maxShown = 10
+	text += strings.Join(failed[:min(len(failed), maxShown)], "\n")
+	if len(failed) > maxShown {
+		text += "\n... and " + strconv.Itoa(len(failed)-maxShown) + " more"
+	}
+	fssize.ShowDialog(text, []string{"OK"}, nil)
+}
+
+// Removes path and everything inside it from the results, subtracting its size from the folders above it
+// If a removed file was the counted one of its hardlinks, one of the others is counted instead
+// The lists are built again from the tree, so the next biggest files and folders take the place of the removed ones
+func (fssize *FSSize) RemoveFromResults(path string) {
+	for markedPath := range fssize.marked {
+		if IsSubPath(path, markedPath) {
+			delete(fssize.marked, markedPath)
+		}
+	}
+
+	if fssize.root == nil {
+		return
+	}
+
+	node := fssize.root.Find(path)
+	if node == nil || node.parent == nil {
+		return
+	}
+
+	if fssize.currentFolder != nil && IsSubPath(path, fssize.currentFolder.Path()) {
+		fssize.OpenFolder(node.parent, "")
+	}
+
+	removedLinks := make(map[Inode][]*Node)
+	collectHardlinks(node, removedLinks)
+	node.Remove()
+
+	// Another hardlink to a removed file still takes up the disk space, so one of them has to be counted instead
+	if len(removedLinks) > 0 {
+		remainingLinks := make(map[Inode][]*Node)
+		collectHardlinks(fssize.root, remainingLinks)
+		for inode, links := range remainingLinks {
+			for _, link := range links {
+				link.linkCount -= min(link.linkCount-1, uint64(len(removedLinks[inode])))
+			}
+		}
+
+		fssize.countHardlinks()
+		fssize.root.RecalculateTotals(fssize.filter)
+	}
+
+	fssize.RebuildLists()
+}
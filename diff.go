@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type DiffStatus int
+
+const (
+	DiffGrown DiffStatus = iota
+	DiffShrunk
+	DiffNew
+	DiffDeleted
+)
+
+var diffStatusNames = []string{"grown", "shrunk", "new", "deleted"}
+
+var diffSortNames = []string{"size", "percent"}
+
+// A file or folder that changed in size between two searches
+type DiffEntry struct {
+	path    string // In the new search, or the old one if it was deleted
+	isDir   bool
+	oldSize int64 // 0 if it is new
+	newSize int64 // 0 if it was deleted
+	status  DiffStatus
+}
+
+func (entry DiffEntry) Delta() int64 {
+	return entry.newSize - entry.oldSize
+}
+
+// Returns the growth relative to the old size, false if the old size was 0
+func (entry DiffEntry) Percent() (float64, bool) {
+	if entry.oldSize == 0 {
+		return 0, false
+	}
+
+	return float64(entry.Delta()) * 100 / float64(entry.oldSize), true
+}
+
+// Like "+35.2%", "new" or "deleted"
+func (entry DiffEntry) ChangeText() string {
+	switch entry.status {
+	case DiffNew:
+		return "new"
+	case DiffDeleted:
+		return "deleted"
+	}
+
+	percent, ok := entry.Percent()
+	if !ok {
+		return "+inf%"
+	}
+
+	text := strconv.FormatFloat(percent, 'f', 1, 64) + "%"
+	if percent >= 0 {
+		text = "+" + text
+	}
+	return text
+}
+
+// Returns the files and folders that are new, deleted or changed in size between the two trees
+// The biggest change comes first, by size or by percent, whether it grew or shrunk
+func DiffTrees(oldRoot, newRoot *Node, byPercent bool) []DiffEntry {
+	var ret []DiffEntry
+	diffNodes(oldRoot, newRoot, &ret)
+
+	sortKey := func(entry DiffEntry) float64 {
+		if !byPercent {
+			return math.Abs(float64(entry.Delta()))
+		}
+
+		// Deleted files shrunk by 100%, but count them as much of a change as new files
+		percent, ok := entry.Percent()
+		if !ok || entry.status == DiffDeleted {
+			return math.Inf(1)
+		}
+		return math.Abs(percent)
+	}
+
+	slices.SortFunc(ret, func(a, b DiffEntry) int {
+		aKey, bKey := sortKey(a), sortKey(b)
+		if aKey < bKey {
+			return 1
+		} else if aKey > bKey {
+			return -1
+		}
+
+		// The same percent, like new and deleted files, still puts the biggest change in size first
+		aDelta, bDelta := math.Abs(float64(a.Delta())), math.Abs(float64(b.Delta()))
+		if aDelta < bDelta {
+			return 1
+		} else if aDelta > bDelta {
+			return -1
+		}
+
+		return strings.Compare(a.path, b.path)
+	})
+	return ret
+}
+
+// Adds oldNode and newNode if they differ in size, and then the differences inside them
+func diffNodes(oldNode, newNode *Node, ret *[]DiffEntry) {
+	if newNode.totalSize != oldNode.totalSize {
+		entry := DiffEntry{path: newNode.Path(), isDir: newNode.isDir, oldSize: oldNode.totalSize, newSize: newNode.totalSize, status: DiffGrown}
+		if entry.Delta() < 0 {
+			entry.status = DiffShrunk
+		}
+		*ret = append(*ret, entry)
+	}
+
+	if !newNode.isDir {
+		return
+	}
+
+	oldChildren := make(map[string]*Node)
+	for _, child := range oldNode.children {
+		if child.Counted() {
+			oldChildren[child.name] = child
+		}
+	}
+
+	for _, child := range newNode.children {
+		if !child.Counted() {
+			continue
+		}
+
+		oldChild, ok := oldChildren[child.name]
+		if ok && oldChild.isDir == child.isDir {
+			diffNodes(oldChild, child, ret)
+			delete(oldChildren, child.name)
+		} else {
+			addAll(child, DiffNew, ret)
+		}
+	}
+
+	for _, oldChild := range oldChildren {
+		addAll(oldChild, DiffDeleted, ret)
+	}
+}
+
+// Adds the node and everything inside it as new or deleted
+func addAll(node *Node, status DiffStatus, ret *[]DiffEntry) {
+	if !node.Counted() {
+		return
+	}
+
+	entry := DiffEntry{path: node.Path(), isDir: node.isDir, status: status}
+	if status == DiffNew {
+		entry.newSize = node.totalSize
+	} else {
+		entry.oldSize = node.totalSize
+	}
+	*ret = append(*ret, entry)
+
+	for _, child := range node.children {
+		addAll(child, status, ret)
+	}
+}
+
+// Loads the snapshot to compare the results against in the Diff tab
+func (fssize *FSSize) LoadDiffSnapshot(path string) error {
+	snapshot, err := ReadSnapshot(path)
+	if err != nil {
+		return err
+	}
+
+	fssize.mutex.Lock()
+	defer fssize.mutex.Unlock()
+
+	fssize.diffOld = snapshot.Tree.Node(nil, fssize.diskUsage)
+	fssize.diffOld.RecalculateTotals(fssize.filter)
+	fssize.diffOldPath = path
+	fssize.UpdateDiff()
+	return nil
+}
+
+// Compares the results against the snapshot given with --diff, keeping the maxCount biggest changes for the Diff tab
+// Expects the mutex to be locked
+func (fssize *FSSize) UpdateDiff() {
+	fssize.diff = nil
+	if fssize.diffOld == nil || fssize.root == nil {
+		return
+	}
+
+	fssize.diff = DiffTrees(fssize.diffOld, fssize.root, fssize.diffByPercent)
+	if len(fssize.diff) > fssize.maxCount {
+		fssize.diff = fssize.diff[:fssize.maxCount]
+	}
+}
+
+// Writes the differences in one of outputFormats, the sizes in the text, csv and tsv formats use blockSize
+func WriteDiff(w io.Writer, entries []DiffEntry, format string, blockSize BlockSize, null bool) error {
+	out := bufio.NewWriter(w)
+
+	signed := func(bytes int64) string {
+		if bytes < 0 {
+			return "-" + blockSize.Format(-bytes)
+		}
+		return "+" + blockSize.Format(bytes)
+	}
+
+	type jsonEntry struct {
+		Path    string   `json:"path"`
+		Type    string   `json:"type"`
+		Status  string   `json:"status"`
+		OldSize int64    `json:"old_size"`
+		NewSize int64    `json:"new_size"`
+		Delta   int64    `json:"delta"`
+		Percent *float64 `json:"percent"` // null when the old size was 0
+	}
+
+	toJSON := func(entry DiffEntry) jsonEntry {
+		ret := jsonEntry{Path: entry.path, Type: "file", Status: diffStatusNames[entry.status], OldSize: entry.oldSize, NewSize: entry.newSize, Delta: entry.Delta()}
+		if entry.isDir {
+			ret.Type = "directory"
+		}
+		if percent, ok := entry.Percent(); ok {
+			ret.Percent = &percent
+		}
+		return ret
+	}
+
+	switch format {
+	case "json":
+		list := []jsonEntry{}
+		for _, entry := range entries {
+			list = append(list, toJSON(entry))
+		}
+
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(list); err != nil {
+			return err
+		}
+	case "ndjson":
+		encoder := json.NewEncoder(out)
+		for _, entry := range entries {
+			if err := encoder.Encode(toJSON(entry)); err != nil {
+				return err
+			}
+		}
+	case "csv", "tsv":
+		csvWriter := csv.NewWriter(out)
+		if format == "tsv" {
+			csvWriter.Comma = '\t'
+		}
+
+		csvWriter.Write([]string{"delta", "change", "old_size", "new_size", "path"})
+		for _, entry := range entries {
+			csvWriter.Write([]string{signed(entry.Delta()), entry.ChangeText(), blockSize.Format(entry.oldSize), blockSize.Format(entry.newSize), entry.path})
+		}
+
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return err
+		}
+	default:
+		// Like "+5000000<TAB>+35.2%<TAB>/path"
+		for _, entry := range entries {
+			line := signed(entry.Delta()) + "\t" + entry.ChangeText() + "\t" + entry.path
+			if null {
+				out.WriteString(line + "\x00")
+			} else if strings.ContainsRune(line, '\n') {
+				printError("Path omitted for containing a newline: \"" + entry.path + "\", use --null (-0) or --format csv to include it")
+			} else {
+				out.WriteString(line + "\n")
+			}
+		}
+	}
+
+	return out.Flush()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// A file or folder that couldn't be read while searching
+type ScanError struct {
+	path    string
+	err     error
+	archive bool // Couldn't look inside the archive with --archives, but its size on disk is still counted
+}
+
+// Returns the error without the path, like "permission denied (errno 13)"
+func (scanError ScanError) Message() string {
+	err := scanError.err
+	var pathError *fs.PathError
+	if errors.As(err, &pathError) {
+		err = pathError.Err
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return err.Error() + " (errno " + strconv.Itoa(int(errno)) + ")"
+	}
+	return err.Error()
+}
+
+func (fssize *FSSize) AddError(path string, err error) {
+	if errors.Is(err, fs.ErrPermission) {
+		fssize.stats.permissionErrors.Add(1)
+	}
+
+	fssize.mutex.Lock()
+	fssize.scanErrors = append(fssize.scanErrors, ScanError{path: path, err: err})
+	fssize.mutex.Unlock()
+}
+
+// Not counted as a read error, since the size of the archive itself is known
+func (fssize *FSSize) AddArchiveError(path string, err error) {
+	fssize.mutex.Lock()
+	fssize.scanErrors = append(fssize.scanErrors, ScanError{path: path, err: err, archive: true})
+	fssize.mutex.Unlock()
+}
+
+func (fssize *FSSize) SortErrors() {
+	slices.SortFunc(fssize.scanErrors, func(a, b ScanError) int {
+		return strings.Compare(a.path, b.path)
+	})
+}
+
+// Writes every error to stderr, followed by how many there were
+func (fssize *FSSize) PrintErrors() {
+	for _, scanError := range fssize.scanErrors {
+		os.Stderr.WriteString(scanError.path + ": " + scanError.Message() + "\n")
+	}
+
+	readErrors, archiveErrors := 0, 0
+	for _, scanError := range fssize.scanErrors {
+		if scanError.archive {
+			archiveErrors++
+		} else {
+			readErrors++
+		}
+	}
+
+	if readErrors > 0 {
+		printError(strconv.Itoa(readErrors) + " files and folders could not be read, the sizes of the folders containing them are incomplete")
+	}
+
+	if archiveErrors > 0 {
+		printError(strconv.Itoa(archiveErrors) + " archives could not be opened, only their size on disk is counted")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A pattern from --exclude or --exclude-from, using the gitignore syntax
+// https://git-scm.com/docs/gitignore#_pattern_format
+type ExcludePattern struct {
+	pattern  string
+	regex    *regexp.Regexp // Matched against the path relative to the searched folder, with '/' separators
+	negate   bool           // "!pattern", includes what an earlier pattern excluded
+	onlyDirs bool           // "pattern/", only matches folders
+}
+
+// Returns nil for blank lines and comments
+func ParseExcludePattern(line string) *ExcludePattern {
+	pattern := &ExcludePattern{pattern: line}
+
+	// Trailing spaces are ignored unless escaped with a backslash
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		pattern.onlyDirs = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	if line == "" {
+		return nil
+	}
+
+	// A slash at the beginning or in the middle anchors the pattern to the searched folder,
+	// otherwise it can match at any depth
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	var regex strings.Builder
+	regex.WriteString("^")
+	if !anchored {
+		regex.WriteString("(?:.*/)?")
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case strings.HasPrefix(line[i:], "**/") && (i == 0 || line[i-1] == '/'):
+			// "**/" matches zero or more folders
+			regex.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(line[i:], "**") && i+2 == len(line) && (i == 0 || line[i-1] == '/'):
+			// A trailing "/**" matches everything inside
+			regex.WriteString(".*")
+			i++
+		case c == '*':
+			regex.WriteString("[^/]*")
+		case c == '?':
+			regex.WriteString("[^/]")
+		case c == '\\' && i+1 < len(line):
+			i++
+			regex.WriteString(regexp.QuoteMeta(string(line[i])))
+		case c == '[':
+			end := strings.IndexByte(line[i+1:], ']')
+			if end == -1 {
+				regex.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+
+			class := line[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			regex.WriteString("[" + strings.ReplaceAll(class, "\\", "\\\\") + "]")
+			i += end + 1
+		default:
+			regex.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	regex.WriteString("$")
+
+	var err error
+	pattern.regex, err = regexp.Compile(regex.String())
+	if err != nil {
+		// Something like an invalid character class, let it match nothing
+		pattern.regex = regexp.MustCompile(`\A\z.`)
+	}
+	return pattern
+}
+
+// Adds the patterns in the file, one per line like a .gitignore file
+func (fssize *FSSize) LoadExcludeFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fssize.AddExclude(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+func (fssize *FSSize) AddExclude(line string) {
+	if pattern := ParseExcludePattern(line); pattern != nil {
+		fssize.excludes = append(fssize.excludes, pattern)
+	}
+}
+
+// Returns true if path is excluded, like git the last matching pattern wins
+func (fssize *FSSize) IsExcluded(path string, isDir bool) bool {
+	if len(fssize.excludes) == 0 {
+		return false
+	}
+
+	relPath, err := filepath.Rel(fssize.rootFolderPath, path)
+	if err != nil || relPath == "." {
+		return false
+	}
+	relPath = filepath.ToSlash(relPath)
+
+	excluded := false
+	for _, pattern := range fssize.excludes {
+		if pattern.onlyDirs && !isDir {
+			continue
+		}
+
+		if pattern.regex.MatchString(relPath) {
+			excluded = !pattern.negate
+		}
+	}
+	return excluded
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+type TimeField int
+
+const (
+	Mtime TimeField = iota // Last modified
+	Atime                  // Last accessed
+	Ctime                  // Last status change
+)
+
+var timeFieldNames = []string{"mtime", "atime", "ctime"}
+
+// Which files are counted, from --min-size, --max-size, --older-than, --newer-than and --time, or the filter bar
+// Folders only count the sizes of the files inside them that match
+type Filter struct {
+	spec      string // Like "min-size=1G older-than=90d", what ParseFilter was given
+	minSize   int64  // 0 when not set
+	maxSize   int64  // -1 when not set
+	olderThan time.Duration
+	newerThan time.Duration
+	timeField TimeField
+	now       time.Time // olderThan and newerThan are relative to this
+}
+
+const filterHelp = "min-size=1G max-size=10GB older-than=90d newer-than=1w time=mtime|atime|ctime"
+
+func NoFilter() Filter {
+	return Filter{maxSize: -1}
+}
+
+// Parses space-separated key=value pairs, like "min-size=1G older-than=90d time=atime"
+func ParseFilter(spec string) (Filter, error) {
+	filter := NoFilter()
+	filter.spec = strings.Join(strings.Fields(spec), " ")
+	filter.now = time.Now()
+
+	for _, field := range strings.Fields(spec) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return filter, errors.New("missing '=' in \"" + field + "\"")
+		}
+
+		var err error
+		switch key {
+		case "min-size":
+			filter.minSize, err = ParseSize(value)
+		case "max-size":
+			filter.maxSize, err = ParseSize(value)
+		case "older-than":
+			filter.olderThan, err = ParseAge(value)
+		case "newer-than":
+			filter.newerThan, err = ParseAge(value)
+		case "time":
+			i := 0
+			for i < len(timeFieldNames) && timeFieldNames[i] != value {
+				i++
+			}
+			if i == len(timeFieldNames) {
+				err = errors.New("must be one of: " + strings.Join(timeFieldNames, ", "))
+			}
+			filter.timeField = TimeField(i)
+		default:
+			return filter, errors.New("unknown filter \"" + key + "\", expected something like: " + filterHelp)
+		}
+
+		if err != nil {
+			return filter, errors.New("invalid " + key + " \"" + value + "\", " + err.Error())
+		}
+	}
+
+	return filter, nil
+}
+
+// Parses a size like "500", "1.5G", "10MB" or "4KiB", the units are the same as in --block-size
+func ParseSize(str string) (int64, error) {
+	numberEnd := 0
+	for numberEnd < len(str) && (str[numberEnd] >= '0' && str[numberEnd] <= '9' || str[numberEnd] == '.') {
+		numberEnd++
+	}
+
+	number, err := strconv.ParseFloat(str[:numberEnd], 64)
+	if err != nil || number < 0 {
+		return 0, errors.New("expected a size like 1.5G, 10MB or 4KiB")
+	}
+
+	unit := str[numberEnd:]
+	if unit == "" || unit == "B" {
+		return int64(number), nil
+	}
+
+	blockSize, err := ParseBlockSize(unit)
+	if err != nil || blockSize.human {
+		return 0, errors.New("unknown unit \"" + unit + "\"")
+	}
+	return int64(number * float64(blockSize.size)), nil
+}
+
+// Parses an age like "90d", "2w", "1y" or "12h30m"
+func ParseAge(str string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+		"y": 365 * 24 * time.Hour,
+	}
+
+	for suffix, unit := range units {
+		if number, ok := strings.CutSuffix(str, suffix); ok {
+			n, err := strconv.ParseFloat(number, 64)
+			if err != nil || n < 0 {
+				return 0, errors.New("expected an age like 90d, 2w, 1y or 12h")
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+
+	age, err := time.ParseDuration(str)
+	if err != nil || age < 0 {
+		return 0, errors.New("expected an age like 90d, 2w, 1y or 12h")
+	}
+	return age, nil
+}
+
+func (filter Filter) Active() bool {
+	return filter.minSize > 0 || filter.maxSize >= 0 || filter.olderThan > 0 || filter.newerThan > 0
+}
+
+// Only used for files, folders match when any file inside them does
+func (filter Filter) Matches(node *Node) bool {
+	if node.totalSize < filter.minSize {
+		return false
+	}
+
+	if filter.maxSize >= 0 && node.totalSize > filter.maxSize {
+		return false
+	}
+
+	if filter.olderThan == 0 && filter.newerThan == 0 {
+		return true
+	}
+
+	var t time.Time
+	switch filter.timeField {
+	case Mtime:
+		t = time.Unix(node.mtime, 0)
+	case Atime:
+		t = time.Unix(node.atime, 0)
+	case Ctime:
+		t = time.Unix(node.ctime, 0)
+	}
+
+	if filter.olderThan > 0 && t.After(filter.now.Add(-filter.olderThan)) {
+		return false
+	}
+
+	if filter.newerThan > 0 && t.Before(filter.now.Add(-filter.newerThan)) {
+		return false
+	}
+
+	return true
+}
+
+// Counts only the files matching filter, without reading anything again
+// If a search is running, the folders read so far are filtered once it has finished
+// Expects the mutex to be locked
+func (fssize *FSSize) SetFilter(filter Filter) {
+	fssize.filter = filter
+	if fssize.diffOld != nil {
+		fssize.diffOld.RecalculateTotals(filter)
+	}
+
+	if fssize.accumulating || fssize.root == nil {
+		return
+	}
+
+	fssize.root.RecalculateTotals(filter)
+	fssize.RebuildLists()
+}
+
+func (fssize *FSSize) FilterBarOpen() bool {
+	return fssize.pages != nil && fssize.pages.HasPage("filter")
+}
+
+// Shows an input field at the bottom of the screen to change the filter
+func (fssize *FSSize) ShowFilterBar() {
+	if fssize.pages == nil {
+		return
+	}
+
+	help := tview.NewTextView().SetDynamicColors(true).SetText("[#a0a0a0::i] " + filterHelp + ", Enter to apply, Esc to cancel")
+	help.SetBackgroundColor(tcell.NewRGBColor(46, 52, 54))
+
+	input := tview.NewInputField().SetLabel(" Filter: ").SetText(fssize.filter.spec)
+	input.SetFieldBackgroundColor(tcell.NewRGBColor(20, 20, 20))
+	input.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEnter {
+			filter, err := ParseFilter(input.GetText())
+			if err != nil {
+				help.SetText("[red] " + tview.Escape(err.Error()))
+				return
+			}
+
+			fssize.mutex.Lock()
+			fssize.SetFilter(filter)
+			fssize.mutex.Unlock()
+		} else if key != tcell.KeyEscape {
+			return
+		}
+
+		fssize.pages.RemovePage("filter")
+		fssize.app.SetFocus(fssize)
+	})
+
+	bar := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(nil, 0, 1, false).
+		AddItem(help, 1, 0, false).
+		AddItem(input, 1, 0, true)
+
+	fssize.pages.AddPage("filter", bar, true, true)
+	fssize.app.SetFocus(input)
+}
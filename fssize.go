@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io/fs"
-	"os"
 	"os/exec"
 	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
@@ -19,25 +22,83 @@ const (
 	Files    Tab = 0
 	Folders      = 1
 	Packages     = 2 // dpkg-query
+	Trash        = 3
+	Mounts       = 4
+	Errors       = 5
+	Diff         = 6 // Compared to the snapshot given with --diff
 )
 
+// Indexed by Tab
+var tabNames = []string{"Files", "Folders", "Packages (dpkg-query)", "Trash", "Mounts", "Errors", "Diff"}
+
 type FSSize struct {
 	*tview.Box
 	app               *tview.Application
+	pages             *tview.Pages
 	currentTab        Tab
 	files             []File
 	folders           []File
 	packages          []File // path = package name, sizeBytes = estimated size in kibibytes
+	trashed           []TrashedFile
+	loadingTrash      bool
+	trashLoads        int             // Increased every time the trash is read again
+	allMounts         []Mount         // Every mount that isn't virtual
+	mounts            []Mount         // Only the ones on a real disk that StatMounts has read the sizes of, biggest first
+	statingMounts     map[string]bool // Mount points statfs is still running on
+	mountsDeadline    time.Time
+	virtualMounts     map[string]bool // Mount points of pseudo filesystems like /proc, which are skipped
 	dpkgQueryWorked   bool
 	maxCount          int
 	ignoreHiddenFiles bool
+	excludes          []*ExcludePattern // From --exclude and --exclude-from
+	archives          bool              // Look inside tar and zip files
+	filter            Filter
+	diskUsage         bool // Use the allocated size instead of the apparent size, like du
+	units             UnitSystem
+	precision         int  // Max amount of decimals shown in sizes
+	oneFileSystem     bool // Don't descend into folders on other filesystems than rootFolderPath
+	rootDevice        uint64
+	skippedMounts     []string      // Mount points not descended into because of oneFileSystem
+	jobs              int           // Amount of goroutines reading folders in parallel
+	mutex             sync.Mutex    // Guards everything the background goroutines change: files, folders, skippedMounts, accumulating, the tree, trashed, mounts and deletingPath
+	changed           chan struct{} // Receives a value when the results have changed and should be redrawn
 	accumulating      bool
+	cancelled         bool // The last search was cancelled before it finished
+	cancelScan        context.CancelFunc
+	scanDone          chan struct{} // Closed when the last search started has finished
+	stats             *ScanStats
+	scanErrors        []ScanError
 	rootFolderPath    string
+	snapshotPath      string // Set when the results were loaded with --load instead of searching
+	diffOld           *Node  // The tree of the snapshot given with --diff
+	diffOldPath       string
+	diff              []DiffEntry
+	diffByPercent     bool
+	root              *Node
+	currentFolder     *Node // When not nil, the Folders tab shows the contents of this folder instead of the biggest folders
+	selected          map[Tab]int
+	scrollOffset      map[Tab]int
+	marked            map[string]File // Files and folders marked for deletion, by path
+	deletingPath      string          // The file or folder being deleted in the background, empty when not deleting
 }
 
 type File struct {
-	path      string
-	sizeBytes int64
+	path         string
+	sizeBytes    int64 // The apparent size, or the allocated size with --disk-usage
+	ownSizeBytes int64 // Only used for folders, the sum of the regular files directly inside it
+
+	apparentBytes     int64
+	allocatedBytes    int64 // Amount of disk space used, can be less than the apparent size for sparse files
+	isDir             bool
+	linkCount         uint64 // Only used for files, the amount of hardlinks to it
+	duplicateLink     bool   // Only used for files, another hardlink to it is counted instead
+	incomplete        bool   // Only used for folders, some of the files inside it couldn't be read
+	mtime             int64  // Unix time in seconds
+	uid               uint32
+	virtual           bool   // Inside an archive, not on disk
+	archivePath       string // Only used for virtual files and folders, the archive they are in
+	archive           bool   // Can be opened like a folder with --archives
+	uncompressedBytes int64  // Only used for archives, the size of the files inside it
 }
 
 func NewFSSize() *FSSize {
@@ -45,22 +106,43 @@ func NewFSSize() *FSSize {
 		Box:             tview.NewBox().SetBackgroundColor(tcell.NewRGBColor(46, 52, 54)),
 		currentTab:      Files,
 		dpkgQueryWorked: true,
+		selected:        make(map[Tab]int),
+		scrollOffset:    make(map[Tab]int),
+		marked:          make(map[string]File),
+		stats:           NewScanStats(),
+		changed:         make(chan struct{}, 1),
+		precision:       3,
+		filter:          NoFilter(),
 	}
 }
 
+// Like "1.5 MB", in the units and precision picked with --units and --precision
+func (fssize *FSSize) FormatBytes(bytes int64) string {
+	return BytesToHumanReadableUnitString(uint64(max(0, bytes)), fssize.units, fssize.precision)
+}
+
 func (fssize *FSSize) TabForward() {
 	fssize.currentTab++
-	fssize.currentTab %= 3
+	fssize.currentTab %= Tab(len(tabNames))
+	if fssize.currentTab == Mounts {
+		fssize.StatMounts()
+	}
 }
 
 func (fssize *FSSize) TabBackward() {
 	fssize.currentTab--
 	if fssize.currentTab < 0 {
-		fssize.currentTab = 2
+		fssize.currentTab = Tab(len(tabNames) - 1)
+	}
+	if fssize.currentTab == Mounts {
+		fssize.StatMounts()
 	}
 }
 
 func (fssize *FSSize) Draw(screen tcell.Screen) {
+	fssize.mutex.Lock()
+	defer fssize.mutex.Unlock()
+
 	x, _, w, h := fssize.GetInnerRect()
 	fssize.Box.DrawForSubclass(screen, fssize)
 
@@ -68,213 +150,500 @@ func (fssize *FSSize) Draw(screen tcell.Screen) {
 	/*for i := x; i < x+w; i++ {
 		screen.SetContent(i, 0, ' ', nil, tcell.StyleDefault.Background(tcell.NewRGBColor(46, 52, 54)).Underline(true))
 	}*/
-	filesStyle := ""
-	folderStyle := ""
-	packagesStyle := ""
-	if fssize.currentTab == Files {
-		filesStyle = "[::br]"
-	} else if fssize.currentTab == Folders {
-		folderStyle = "[::br]"
-	} else if fssize.currentTab == Packages {
-		packagesStyle = "[::br]"
+	tabsText := ""
+	for tab, name := range tabNames {
+		if Tab(tab) == fssize.currentTab {
+			tabsText += "[::br]"
+		}
+		tabsText += " " + name + " [-:-:-:-]"
 	}
 
-	tview.Print(screen, filesStyle+" Files [-:-:-:-]"+folderStyle+" Folders [-:-:-:-]"+packagesStyle+" Packages (dpkg-query) [-:-:-:-]", 0, 0, w, tview.AlignLeft, tcell.ColorDefault)
-	tview.Print(screen, "<- Press Tab or Shift+Tab to switch ", 0, 0, w, tview.AlignRight, tcell.ColorDefault)
+	tview.Print(screen, tabsText, 0, 0, w, tview.AlignLeft, tcell.ColorDefault)
+	if fssize.currentTab == Folders && fssize.currentFolder != nil {
+		tview.Print(screen, fssize.Breadcrumb(w/2)+" ", 0, 0, w, tview.AlignRight, tcell.ColorDefault)
+	} else if fssize.currentTab == Diff && fssize.diffOld != nil {
+		sortedBy := "size"
+		if fssize.diffByPercent {
+			sortedBy = "percent"
+		}
+		tview.Print(screen, "Change by "+sortedBy+", press 's' to change ", 0, 0, w, tview.AlignRight, tcell.ColorDefault)
+	} else {
+		tview.Print(screen, "<- Press Tab or Shift+Tab to switch ", 0, 0, w, tview.AlignRight, tcell.ColorDefault)
+	}
 
-	ptr := &fssize.files
-	if fssize.currentTab == Folders {
-		ptr = &fssize.folders
-	} else if fssize.currentTab == Packages {
-		ptr = &fssize.packages
+	list := fssize.CurrentList()
+	basePath := fssize.rootFolderPath
+	if fssize.currentTab == Folders && fssize.currentFolder != nil {
+		basePath = fssize.currentFolder.Path()
 	}
 
-	if fssize.currentTab == Packages && len(*ptr) == 0 {
+	listHeight := fssize.ListHeight()
+	fssize.ClampSelection(len(list), listHeight)
+	offset := fssize.scrollOffset[fssize.currentTab]
+
+	if fssize.currentTab == Packages && len(list) == 0 {
 		tview.Print(screen, "[::b]Failed to run dpkg-query", 0, h/2, w, tview.AlignCenter, tcell.ColorDefault)
+	} else if fssize.currentTab == Trash && len(list) == 0 && fssize.loadingTrash {
+		tview.Print(screen, "[::b]Reading the trash...", 0, h/2, w, tview.AlignCenter, tcell.ColorDefault)
+	} else if fssize.currentTab == Trash && len(list) == 0 {
+		tview.Print(screen, "[::b]The trash is empty", 0, h/2, w, tview.AlignCenter, tcell.ColorDefault)
+	} else if fssize.currentTab == Mounts && len(list) == 0 && len(fssize.statingMounts) > 0 {
+		tview.Print(screen, "[::b]Reading the mounts...", 0, h/2, w, tview.AlignCenter, tcell.ColorDefault)
+	} else if fssize.currentTab == Mounts && len(list) == 0 {
+		tview.Print(screen, "[::b]Failed to read /proc/self/mountinfo", 0, h/2, w, tview.AlignCenter, tcell.ColorDefault)
+	} else if fssize.currentTab == Errors && len(list) == 0 {
+		tview.Print(screen, "[::b]No errors", 0, h/2, w, tview.AlignCenter, tcell.ColorDefault)
+	} else if fssize.currentTab == Diff && len(list) == 0 {
+		text := "No changes since " + fssize.diffOldPath
+		if fssize.diffOld == nil {
+			text = "Start with --diff OLD_SNAPSHOT to compare against a search saved with --save"
+		} else if fssize.accumulating {
+			text = "Comparing with " + fssize.diffOldPath + " once the search has finished"
+		}
+		tview.Print(screen, "[::b]"+tview.Escape(text), 0, h/2, w, tview.AlignCenter, tcell.ColorDefault)
 	} else {
-		for i := 0; i < len(*ptr); i++ {
-			if i+1 >= h-1 { // The bottom row is occupied by the bottom bar
+		for i := offset; i < len(list); i++ {
+			y := i - offset + 1
+			if y > listHeight {
 				break
 			}
 
 			styleText := ""
-			if i%2 == 0 {
+			backgroundColor := tcell.ColorDefault
+			if i == fssize.selected[fssize.currentTab] {
+				styleText = "[:#3465a4:]"
+				backgroundColor = tcell.NewRGBColor(0x34, 0x65, 0xa4)
+			} else if i%2 == 0 {
 				styleText = "[:#141414:]"
+				backgroundColor = tcell.NewRGBColor(0x14, 0x14, 0x14)
 			}
 
 			var relPath string
-			if fssize.rootFolderPath == "/" {
-				relPath = (*ptr)[i].path
+			if (fssize.currentTab != Files && fssize.currentTab != Folders && fssize.currentTab != Diff) || basePath == "/" {
+				relPath = list[i].path
 			} else {
 				var err error
-				relPath, err = filepath.Rel(fssize.rootFolderPath, (*ptr)[i].path)
+				relPath, err = filepath.Rel(basePath, list[i].path)
 				if err != nil {
-					relPath = (*ptr)[i].path
+					relPath = list[i].path
 				}
 			}
 
-			prefix := ""
-			if fssize.currentTab == Packages {
-				prefix = "~"
+			if fssize.currentTab == Folders && fssize.currentFolder != nil && list[i].isDir {
+				relPath += string(filepath.Separator)
 			}
-			_, sizePrintedLength := tview.Print(screen, styleText+"[::b]"+prefix+BytesToHumanReadableUnitString(uint64((*ptr)[i].sizeBytes), 3), 0, i+1, w, tview.AlignRight, tcell.ColorWhite)
+
+			sizeText := fssize.SizeColumnsText(i, list[i], styleText)
+			_, sizePrintedLength := tview.Print(screen, sizeText, 0, y, w, tview.AlignRight, tcell.ColorWhite)
 			// Flawed when FilenameInvisibleCharactersAsCodeHighlighted does anything
 			if len(relPath) > w-sizePrintedLength-1 {
 				relPath = relPath[:max(0, w-sizePrintedLength-1-3)] + "[#606060]..."
 			}
 
 			filenameText := FilenameInvisibleCharactersAsCodeHighlighted(relPath, styleText)
-			_, pathPrintedLength := tview.Print(screen, styleText+filenameText, 0, i+1, w-sizePrintedLength, tview.AlignLeft, tcell.NewRGBColor(200, 200, 200))
+			if _, ok := fssize.marked[list[i].path]; ok {
+				filenameText = "[yellow::b]*[-::-] " + filenameText
+			}
+			_, pathPrintedLength := tview.Print(screen, styleText+filenameText, 0, y, w-sizePrintedLength, tview.AlignLeft, tcell.NewRGBColor(200, 200, 200))
 
-			if i%2 == 0 {
+			if backgroundColor != tcell.ColorDefault {
 				for j := pathPrintedLength; j < w-sizePrintedLength; j++ {
-					screen.SetContent(j, i+1, ' ', nil, tcell.StyleDefault.Background(tcell.NewRGBColor(0x14, 0x14, 0x14)))
+					screen.SetContent(j, y, ' ', nil, tcell.StyleDefault.Background(backgroundColor))
 				}
 			}
 		}
 	}
 
+	note := fssize.Note()
+	if note != "" {
+		tview.Print(screen, "[#a0a0a0::i] "+tview.Escape(note), 0, h-2, w, tview.AlignLeft, tcell.ColorDefault)
+	}
+
 	// Bottom bar
 	color := tcell.ColorYellow
-	if !fssize.accumulating {
+	if fssize.cancelled {
+		color = tcell.NewRGBColor(255, 140, 0)
+	} else if !fssize.accumulating {
 		color = tcell.NewRGBColor(0, 255, 0)
 	}
 	for i := x; i < x+w; i++ {
 		//		screen.SetContent(i, h-1, ' ', nil, tcell.StyleDefault.Background(tcell.ColorWhite))
 		screen.SetContent(i, h-1, ' ', nil, tcell.StyleDefault.Background(color))
 	}
+	var statusLength int
 	if fssize.accumulating {
-		tview.Print(screen, "[:yellow] Searching... ", 0, h-1, w, tview.AlignLeft, tcell.ColorBlack)
+		_, statusLength = tview.Print(screen, "[:yellow] Searching... (Esc to cancel) ", 0, h-1, w, tview.AlignLeft, tcell.ColorBlack)
+	} else if fssize.cancelled {
+		_, statusLength = tview.Print(screen, "[:#ff8c00:] Cancelled ", 0, h-1, w, tview.AlignLeft, tcell.ColorBlack)
 	} else {
-		tview.Print(screen, "[:#00ff00:] Finished ", 0, h-1, w, tview.AlignLeft, tcell.ColorBlack)
+		_, statusLength = tview.Print(screen, "[:#00ff00:] Finished ", 0, h-1, w, tview.AlignLeft, tcell.ColorBlack)
 	}
 
-	tview.Print(screen, programName+" "+version, 0, h-1, w, tview.AlignCenter, tcell.ColorBlack)
-	tview.Print(screen, "Press 'q' to quit ", 0, h-1, w, tview.AlignRight, tcell.ColorBlack)
+	statusText := " " + fssize.stats.String(fssize.units, fssize.precision)
+	if len(list) > 0 {
+		statusText = " Row " + strconv.Itoa(fssize.selected[fssize.currentTab]+1) + " of " + strconv.Itoa(len(list)) + " |" + statusText
+	}
+	_, rightLength := tview.Print(screen, " "+programName+" "+version+" | Press 'q' to quit ", 0, h-1, w, tview.AlignRight, tcell.ColorBlack)
+	tview.Print(screen, tview.Escape(statusText), statusLength, h-1, max(0, w-statusLength-rightLength), tview.AlignLeft, tcell.ColorBlack)
 }
 
-func (fssize *FSSize) SortFiles(files *[]File) {
-	slices.SortFunc(*files, func(a, b File) int {
-		if a.sizeBytes < b.sizeBytes {
-			return 1
-		} else if a.sizeBytes > b.sizeBytes {
-			return -1
+// Returns the text on the right side of row i in the current tab, the size columns
+func (fssize *FSSize) SizeColumnsText(i int, file File, styleText string) string {
+	sizeText := "[white::b]" + fmt.Sprintf("%10s", fssize.FormatBytes(file.sizeBytes))
+
+	switch fssize.currentTab {
+	case Packages:
+		return styleText + "[::b]~" + fssize.FormatBytes(file.sizeBytes)
+	case Trash:
+		return styleText + "[#808080]" + fssize.trashed[i].deletionDate.Format(time.DateTime) + "  " + sizeText
+	case Errors:
+		// The size of an archive that couldn't be opened is still counted
+		if fssize.scanErrors[i].archive {
+			return styleText + "[yellow]" + tview.Escape(fssize.scanErrors[i].Message())
+		}
+		return styleText + "[red]" + tview.Escape(fssize.scanErrors[i].Message())
+	case Diff:
+		entry := fssize.diff[i]
+		color := "[red]"
+		if entry.Delta() < 0 {
+			color = "[green]"
 		}
 
-		return 0
-	})
-}
+		delta := fssize.FormatBytes(entry.Delta())
+		if entry.Delta() < 0 {
+			delta = "-" + fssize.FormatBytes(-entry.Delta())
+		} else {
+			delta = "+" + delta
+		}
+		return styleText + "[#808080]" + fmt.Sprintf("%10s", fssize.FormatBytes(entry.oldSize)) + " -> " + fmt.Sprintf("%10s", fssize.FormatBytes(entry.newSize)) + "  " + color + fmt.Sprintf("%8s", entry.ChangeText()) + "  [::b]" + fmt.Sprintf("%11s", delta)
+	case Mounts:
+		mount := fssize.mounts[i]
+		// Calculated the same way as df, which leaves out the blocks reserved for root
+		usedPercent := strconv.FormatInt(mount.usedBytes*100/max(1, mount.usedBytes+mount.freeBytes), 10) + "% used"
+		return styleText + "[#808080]" + tview.Escape(mount.source) + " " + mount.fsType + "  " + fmt.Sprintf("%8s", usedPercent) + "  " + fmt.Sprintf("%10s", fssize.FormatBytes(mount.freeBytes)) + " free of " + fmt.Sprintf("%10s", fssize.FormatBytes(mount.totalBytes)) + "  " + sizeText
+	case Folders:
+		// The size of the files directly inside the folder, followed by the cumulative size
+		ownSizeText := ""
+		if file.isDir {
+			ownSizeText = fssize.FormatBytes(file.ownSizeBytes)
+		}
+		sizeText = "[#808080]" + fmt.Sprintf("%10s", ownSizeText) + "  " + sizeText
+	}
 
-// https://cs.opensource.google/go/go/+/refs/tags/go1.23.1:src/path/filepath/path.go;l=309
-func (fssize *FSSize) walkDir(path string, d fs.DirEntry, walkDirFn fs.WalkDirFunc) error {
-	if err := walkDirFn(path, d, nil); err != nil || !d.IsDir() {
-		if err == fs.SkipDir && d.IsDir() {
-			err = nil
+	// The size we are not sorting by, so both the apparent and allocated size are visible
+	var otherSizeText string
+	if file.virtual {
+		// Inside an archive, the allocated size is the compressed size, it's unknown for tar.gz files so it's the same as the apparent size
+		if file.allocatedBytes == file.apparentBytes {
+			otherSizeText = ""
+		} else if fssize.diskUsage {
+			otherSizeText = fssize.FormatBytes(file.apparentBytes) + " uncompressed"
+		} else {
+			otherSizeText = fssize.FormatBytes(file.allocatedBytes) + " compressed"
 		}
+	} else if fssize.diskUsage {
+		otherSizeText = fssize.FormatBytes(file.apparentBytes) + " apparent"
+	} else {
+		otherSizeText = fssize.FormatBytes(file.allocatedBytes) + " on disk"
+	}
+	sizeText = "[#808080]" + fmt.Sprintf("%19s", otherSizeText) + "  " + sizeText
 
-		return err
+	if file.isDir && file.incomplete {
+		sizeText = "[red]incomplete  " + sizeText
 	}
 
-	files, err := os.ReadDir(path)
-	if err != nil {
-		err = walkDirFn(path, d, err)
-		if err != nil {
-			if err == fs.SkipDir && d.IsDir() {
-				err = nil
-			}
+	if !file.isDir && IsSparse(file.apparentBytes, file.allocatedBytes) {
+		sizeText = "[orange]sparse  " + sizeText
+	}
 
-			return err
-		}
+	if file.duplicateLink {
+		sizeText = "[#808080]" + strconv.FormatUint(file.linkCount, 10) + " links, counted elsewhere  " + sizeText
+	} else if file.linkCount > 1 {
+		sizeText = "[#808080]" + strconv.FormatUint(file.linkCount, 10) + " links  " + sizeText
 	}
 
-	directories := []fs.DirEntry{}
-	var dirSize int64
-	for _, file := range files {
-		if file.IsDir() {
-			directories = append(directories, file)
-			continue
-		}
+	if file.archive {
+		sizeText = "[#808080]" + fssize.FormatBytes(file.uncompressedBytes) + " uncompressed  " + sizeText
+	}
 
-		if !file.Type().IsRegular() {
-			continue
-		}
+	return styleText + sizeText
+}
+
+// Returns a line of text shown above the bottom bar, or an empty string if there is nothing to note
+func (fssize *FSSize) Note() string {
+	if fssize.accumulating {
+		return "Reading " + fssize.stats.CurrentFolder()
+	}
 
-		info, infoErr := file.Info()
-		if infoErr == nil {
-			dirSize += info.Size()
+	var notes []string
+	if fssize.deletingPath != "" {
+		notes = append(notes, "Deleting "+fssize.deletingPath+"...")
+	}
+
+	if hungMounts := fssize.HungMounts(); fssize.currentTab == Mounts && len(hungMounts) > 0 {
+		notes = append(notes, "Not responding: "+strings.Join(hungMounts, ", "))
+	}
+
+	if fssize.snapshotPath != "" {
+		notes = append(notes, "Snapshot "+fssize.snapshotPath+" from "+fssize.stats.startTime.Local().Format(time.DateTime))
+	}
+
+	if fssize.filter.Active() {
+		notes = append(notes, "Filter: "+fssize.filter.spec)
+	}
+
+	if len(fssize.skippedMounts) > 0 {
+		notes = append(notes, "Skipped other filesystems: "+strings.Join(fssize.skippedMounts, ", "))
+	}
+
+	return strings.Join(notes, " | ")
+}
+
+// Returns the amount of rows available for the list, the top and bottom rows are occupied by the top and bottom bar
+func (fssize *FSSize) ListHeight() int {
+	_, _, _, h := fssize.GetInnerRect()
+	if fssize.Note() != "" {
+		return h - 3
+	}
+
+	return h - 2
+}
+
+// Keeps the selected row within the list, and scrolls so that it is visible in a viewport of height rows
+func (fssize *FSSize) ClampSelection(length, height int) {
+	selected := max(0, min(length-1, fssize.selected[fssize.currentTab]))
+	offset := fssize.scrollOffset[fssize.currentTab]
+
+	if selected < offset {
+		offset = selected
+	} else if height > 0 && selected >= offset+height {
+		offset = selected - height + 1
+	}
+	offset = max(0, min(offset, length-height))
+
+	fssize.selected[fssize.currentTab] = selected
+	fssize.scrollOffset[fssize.currentTab] = offset
+}
+
+// Moves the cursor by delta rows, staying within the current list
+func (fssize *FSSize) MoveSelection(delta int) {
+	length := len(fssize.CurrentList())
+	fssize.selected[fssize.currentTab] = max(0, min(length-1, fssize.selected[fssize.currentTab]+delta))
+}
+
+// Returns the list shown in the current tab
+func (fssize *FSSize) CurrentList() []File {
+	switch fssize.currentTab {
+	case Folders:
+		if fssize.currentFolder == nil {
+			return fssize.folders
 		}
 
-		path1 := filepath.Join(path, file.Name())
-		err := walkDirFn(path1, file, nil)
-		if err != nil {
-			return err
+		var ret []File
+		for _, child := range fssize.currentFolder.SortedChildren() {
+			ret = append(ret, child.File())
+		}
+		return ret
+	case Packages:
+		return fssize.packages
+	case Trash:
+		var ret []File
+		for _, trashed := range fssize.trashed {
+			ret = append(ret, File{path: trashed.originalPath, sizeBytes: trashed.sizeBytes, isDir: trashed.isDir})
+		}
+		return ret
+	case Errors:
+		var ret []File
+		for _, scanError := range fssize.scanErrors {
+			ret = append(ret, File{path: scanError.path})
 		}
+		return ret
+	case Diff:
+		var ret []File
+		for _, entry := range fssize.diff {
+			ret = append(ret, File{path: entry.path, sizeBytes: entry.newSize, isDir: entry.isDir})
+		}
+		return ret
+	case Mounts:
+		var ret []File
+		for _, mount := range fssize.mounts {
+			ret = append(ret, File{path: mount.mountPoint, sizeBytes: mount.usedBytes, isDir: true})
+		}
+		return ret
 	}
 
-	if len(fssize.folders) >= fssize.maxCount {
-		if dirSize >= fssize.folders[len(fssize.folders)-1].sizeBytes {
-			fssize.folders = fssize.folders[:len(fssize.folders)-1]
-			fssize.folders = append(fssize.folders, File{path: path, sizeBytes: dirSize})
-			fssize.SortFiles(&fssize.folders)
+	return fssize.files
+}
 
-			/*if fssize.app != nil && fssize.currentTab == Folders {
-				fssize.app.QueueUpdateDraw(func() {})
-			}*/
-		}
-	} else {
-		fssize.folders = append(fssize.folders, File{path: path, sizeBytes: dirSize})
-		fssize.SortFiles(&fssize.folders)
+// Returns the path of the current folder like "/ > var > lib", cut off from the left to fit in maxWidth
+func (fssize *FSSize) Breadcrumb(maxWidth int) string {
+	var names []string
+	for node := fssize.currentFolder; node != nil; node = node.parent {
+		names = append([]string{node.name}, names...)
 	}
 
-	/*		if len(fssize.files) >= fssize.maxCount {
-				if info.Size() < fssize.files[len(fssize.files)-1].sizeBytes {
-					return nil
-				}
+	ret := strings.Join(names, " > ")
+	if len(ret) > maxWidth {
+		ret = "..." + ret[max(0, len(ret)-maxWidth+3):]
+	}
+	return tview.Escape(ret)
+}
+
+// Shows the contents of folder in the Folders tab, with the row at path selected if it exists
+func (fssize *FSSize) OpenFolder(folder *Node, selectPath string) {
+	fssize.currentTab = Folders
+	fssize.currentFolder = folder
+	fssize.selected[Folders] = 0
+	fssize.scrollOffset[Folders] = 0
+
+	for i, e := range fssize.CurrentList() {
+		if e.path == selectPath {
+			fssize.selected[Folders] = i
+			break
+		}
+	}
+}
 
-				fssize.files = fssize.files[:len(fssize.files)-1]
-				fssize.files = append(fssize.files, File{path: path, sizeBytes: info.Size()})
-				fssize.SortFiles()
+func (fssize *FSSize) InputHandler() func(event *tcell.EventKey, setFocus func(p tview.Primitive)) {
+	return fssize.WrapInputHandler(func(event *tcell.EventKey, setFocus func(p tview.Primitive)) {
+		fssize.mutex.Lock()
+		defer fssize.mutex.Unlock()
+
+		list := fssize.CurrentList()
+		pageHeight := max(1, fssize.ListHeight())
+
+		switch event.Key() {
+		case tcell.KeyUp:
+			fssize.MoveSelection(-1)
+		case tcell.KeyDown:
+			fssize.MoveSelection(1)
+		case tcell.KeyPgUp:
+			fssize.MoveSelection(-pageHeight)
+		case tcell.KeyPgDn:
+			fssize.MoveSelection(pageHeight)
+		case tcell.KeyHome:
+			fssize.selected[fssize.currentTab] = 0
+		case tcell.KeyEnd:
+			fssize.selected[fssize.currentTab] = max(0, len(list)-1)
+		case tcell.KeyEnter:
+			if fssize.root == nil || fssize.selected[fssize.currentTab] >= len(list) {
+				return
+			}
 
-				if fssize.app != nil {
-					fssize.app.QueueUpdateDraw(func() {})
+			selected := list[fssize.selected[fssize.currentTab]]
+			if fssize.currentTab == Files {
+				// Show the folder containing the file
+				folder := fssize.root.Find(filepath.Dir(selected.path))
+				if folder != nil {
+					fssize.OpenFolder(folder, selected.path)
+				}
+			} else if fssize.currentTab == Folders && (selected.isDir || selected.archive) {
+				folder := fssize.root.Find(selected.path)
+				if folder != nil {
+					fssize.OpenFolder(folder, "")
 				}
-				return nil
+			}
+		case tcell.KeyEscape:
+			fssize.CancelScan()
+		case tcell.KeyDelete:
+			if fssize.currentTab == Trash {
+				fssize.ConfirmPurge()
+			} else {
+				fssize.ConfirmDelete(false)
+			}
+		case tcell.KeyRune:
+			switch event.Rune() {
+			case ' ':
+				fssize.ToggleMark()
+				fssize.MoveSelection(1)
+			case 'd':
+				if fssize.currentTab == Trash {
+					fssize.ConfirmPurge()
+				} else {
+					fssize.ConfirmDelete(false)
+				}
+			case 't':
+				fssize.ConfirmDelete(true)
+			case 'f':
+				fssize.ShowFilterBar()
+			case 's':
+				if fssize.currentTab == Diff {
+					fssize.diffByPercent = !fssize.diffByPercent
+					fssize.UpdateDiff()
+				}
+			case 'r':
+				if fssize.currentTab == Trash {
+					fssize.RestoreSelected()
+				} else {
+					fssize.Rescan(nil)
+				}
+			case 'R':
+				if fssize.currentTab == Files || fssize.currentTab == Folders {
+					if folder := fssize.SelectedFolder(); folder != nil && !fssize.accumulating {
+						fssize.Rescan(folder)
+					}
+				}
+			}
+		case tcell.KeyBackspace, tcell.KeyBackspace2:
+			if fssize.currentTab != Folders || fssize.currentFolder == nil {
+				return
 			}
 
-			fssize.files = append(fssize.files, File{path: path, sizeBytes: info.Size()})
-			fssize.SortFiles()*/
-
-	for _, d1 := range directories {
-		path1 := filepath.Join(path, d1.Name())
-		if err := fssize.walkDir(path1, d1, walkDirFn); err != nil {
-			if err == fs.SkipDir {
-				break
+			previous := fssize.currentFolder
+			if previous.parent == nil {
+				// Go back to the list of the biggest folders
+				fssize.currentFolder = nil
+				fssize.selected[Folders] = 0
+				fssize.scrollOffset[Folders] = 0
+				return
 			}
 
-			return err
+			fssize.OpenFolder(previous.parent, previous.Path())
 		}
+	})
+}
+
+// Returns the apparent size of the file, or the allocated size with --disk-usage
+func (fssize *FSSize) Size(info fs.FileInfo) int64 {
+	if fssize.diskUsage {
+		return AllocatedSize(info)
 	}
 
-	return nil
+	return info.Size()
 }
 
-// https://cs.opensource.google/go/go/+/refs/tags/go1.23.1:src/path/filepath/path.go;l=395
-func (fssize *FSSize) WalkDir(root string, fn fs.WalkDirFunc) error {
-	info, err := os.Lstat(root)
-	if err != nil {
-		err = fn(root, nil, err)
-	} else {
-		err = fssize.walkDir(root, fs.FileInfoToDirEntry(info), fn)
+// Inserts file into the sorted list, keeping at most fssize.maxCount of the biggest ones
+func (fssize *FSSize) InsertFile(files *[]File, file File) {
+	if len(*files) >= fssize.maxCount {
+		if compareFiles(file, (*files)[len(*files)-1]) > 0 {
+			return
+		}
+
+		*files = (*files)[:len(*files)-1]
 	}
-	if err == fs.SkipDir || err == fs.SkipAll {
-		return nil
+
+	*files = append(*files, file)
+	fssize.SortFiles(files)
+}
+
+// Biggest first, and alphabetically by path when the size is the same
+func compareFiles(a, b File) int {
+	if a.sizeBytes < b.sizeBytes {
+		return 1
+	} else if a.sizeBytes > b.sizeBytes {
+		return -1
 	}
-	return err
+
+	return strings.Compare(a.path, b.path)
 }
 
-func (fssize *FSSize) AccumulatePackages() error {
+func (fssize *FSSize) SortFiles(files *[]File) {
+	slices.SortFunc(*files, compareFiles)
+}
+
+func (fssize *FSSize) AccumulatePackages(ctx context.Context) error {
 	// According to the man page, --showformat has a short option '-f' since dpkg 1.13.1, so let's use the long option
-	output, err := exec.Command("dpkg-query", "--show", "--showformat=${Installed-Size},${Package}\n").Output()
+	output, err := exec.CommandContext(ctx, "dpkg-query", "--show", "--showformat=${Installed-Size},${Package}\n").Output()
 	if err != nil {
 		fssize.dpkgQueryWorked = false
 		return err
@@ -322,57 +691,184 @@ func (fssize *FSSize) AccumulatePackages() error {
 	return nil
 }
 
-func (fssize *FSSize) AccumulateFilesAndFolders() error {
+// Searches fssize.rootFolderPath, or only folder if it is not nil, until done or ctx is cancelled
+func (fssize *FSSize) AccumulateFilesAndFolders(ctx context.Context, folder *Node) error {
+	fssize.rootDevice, _ = deviceOf(fssize.rootFolderPath)
+
+	stats := NewScanStats()
+	fssize.mutex.Lock()
 	fssize.accumulating = true
-	//	err := filepath.WalkDir(fssize.rootFolderPath, func(path string, e fs.DirEntry, err error) error {
-	err := fssize.WalkDir(fssize.rootFolderPath, func(path string, e fs.DirEntry, err error) error {
-		if fssize.ignoreHiddenFiles {
-			if strings.HasPrefix(e.Name(), ".") {
-				if e.IsDir() {
-					return filepath.SkipDir
-				} else {
-					return nil
-				}
+	fssize.cancelled = false
+	fssize.stats = stats
+	fssize.snapshotPath = ""
+	if folder == nil {
+		fssize.skippedMounts = nil
+	}
+	fssize.mutex.Unlock()
+
+	// Keep the elapsed time in the bottom bar ticking, even if we're stuck reading a slow folder
+	walkDone := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fssize.NotifyChanged()
+			case <-walkDone:
+				return
 			}
 		}
+	}()
 
-		if (path == "/dev" || path == "/proc" || path == "/sys" || path == "/home/.ecryptfs") && e.IsDir() {
-			return filepath.SkipDir
-		}
+	err := fssize.Walk(ctx, folder)
+	close(walkDone)
+	stats.Finish()
 
-		if !e.Type().IsRegular() {
-			return nil
-		}
+	fssize.mutex.Lock()
+	fssize.accumulating = false
+	fssize.cancelled = ctx.Err() != nil
+	fssize.mutex.Unlock()
 
-		info, infoErr := e.Info()
-		if infoErr != nil {
-			return nil
-		}
+	fssize.NotifyChanged()
+	return err
+}
 
-		if len(fssize.files) >= fssize.maxCount {
-			if info.Size() < fssize.files[len(fssize.files)-1].sizeBytes {
-				return nil
-			}
+// Starts searching in the background, cancelling the search that is already running if there is one
+// If folder is not nil, only that folder is searched again
+func (fssize *FSSize) StartScan(folder *Node) {
+	fssize.CancelScan()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fssize.cancelScan = cancel
 
-			fssize.files = fssize.files[:len(fssize.files)-1]
-			fssize.files = append(fssize.files, File{path: path, sizeBytes: info.Size()})
-			fssize.SortFiles(&fssize.files)
+	previousDone := fssize.scanDone
+	done := make(chan struct{})
+	fssize.scanDone = done
 
-			/*if fssize.app != nil && fssize.currentTab == Files {
-				fssize.app.QueueUpdateDraw(func() {})
-			}*/
-			return nil
+	if folder == nil {
+		fssize.currentFolder = nil
+		fssize.marked = make(map[string]File)
+	} else if fssize.currentFolder != nil && IsSubPath(folder.Path(), fssize.currentFolder.Path()) {
+		fssize.currentFolder = folder
+	}
+
+	go func() {
+		if previousDone != nil {
+			<-previousDone
 		}
 
-		fssize.files = append(fssize.files, File{path: path, sizeBytes: info.Size()})
-		fssize.SortFiles(&fssize.files)
+		fssize.AccumulateFilesAndFolders(ctx, folder)
+		close(done)
+	}()
+}
+
+// Like StartScan, but not when the results were loaded with --load, since the snapshot might be from another machine
+func (fssize *FSSize) Rescan(folder *Node) {
+	if fssize.deletingPath != "" {
+		fssize.ShowDialog("Wait for "+fssize.deletingPath+" to be deleted before searching again", []string{"OK"}, nil)
+		return
+	}
+
+	if fssize.snapshotPath != "" {
+		fssize.ShowDialog("Can't search again, the results were loaded from "+fssize.snapshotPath+"\n\nStart fssize without --load to search this machine", []string{"OK"}, nil)
+		return
+	}
+
+	fssize.StartScan(folder)
+}
+
+func (fssize *FSSize) CancelScan() {
+	if fssize.cancelScan != nil {
+		fssize.cancelScan()
+	}
+}
 
+// Returns the selected folder in the Folders tab, or the folder containing the selected file
+func (fssize *FSSize) SelectedFolder() *Node {
+	list := fssize.CurrentList()
+	selected := fssize.selected[fssize.currentTab]
+	if fssize.root == nil || selected >= len(list) {
 		return nil
-	})
+	}
 
-	fssize.accumulating = false
-	if fssize.app != nil {
-		fssize.app.QueueUpdateDraw(func() {})
+	path := list[selected].path
+	if !list[selected].isDir {
+		path = filepath.Dir(path)
 	}
-	return err
+
+	// Archives can't be searched on their own, so use the folder the archive is in
+	folder := fssize.root.Find(path)
+	for folder != nil && (folder.virtual || folder.archive) {
+		folder = folder.parent
+	}
+	return folder
+}
+
+// Lets the UI know it should redraw, without blocking
+func (fssize *FSSize) NotifyChanged() {
+	select {
+	case fssize.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Shows a dialog on top of everything, done is called with the label of the chosen button, or an empty string if cancelled
+func (fssize *FSSize) ShowDialog(text string, buttons []string, done func(label string)) {
+	if fssize.pages == nil {
+		return
+	}
+
+	modal := tview.NewModal().SetText(text).AddButtons(buttons)
+	modal.SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+		fssize.pages.RemovePage("dialog")
+		fssize.app.SetFocus(fssize)
+		if done != nil {
+			fssize.mutex.Lock()
+			defer fssize.mutex.Unlock()
+			done(buttonLabel)
+		}
+	})
+
+	fssize.pages.AddPage("dialog", modal, false, true)
+	fssize.app.SetFocus(modal)
+}
+
+// Also true when the filter bar is open
+func (fssize *FSSize) DialogOpen() bool {
+	return fssize.pages != nil && fssize.pages.HasPage("dialog") || fssize.FilterBarOpen()
+}
+
+func (fssize *FSSize) MouseHandler() func(action tview.MouseAction, event *tcell.EventMouse, setFocus func(p tview.Primitive)) (consumed bool, capture tview.Primitive) {
+	return fssize.WrapMouseHandler(func(action tview.MouseAction, event *tcell.EventMouse, setFocus func(p tview.Primitive)) (consumed bool, capture tview.Primitive) {
+		// Keep the focus in the filter bar
+		if fssize.FilterBarOpen() {
+			return false, nil
+		}
+
+		fssize.mutex.Lock()
+		defer fssize.mutex.Unlock()
+
+		switch action {
+		case tview.MouseScrollUp:
+			fssize.MoveSelection(-3)
+			return true, nil
+		case tview.MouseScrollDown:
+			fssize.MoveSelection(3)
+			return true, nil
+		case tview.MouseLeftClick:
+			_, y := event.Position()
+			if y < 1 || y > fssize.ListHeight() {
+				return false, nil
+			}
+
+			row := fssize.scrollOffset[fssize.currentTab] + y - 1
+			if row < len(fssize.CurrentList()) {
+				fssize.selected[fssize.currentTab] = row
+			}
+			return true, nil
+		}
+
+		return false, nil
+	})
 }
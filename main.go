@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 	"time"
 
@@ -22,14 +26,52 @@ func printError(str string) {
 	os.Stderr.WriteString("\x1b[0;31m" + programName + ": " + str + "\x1b[0m\n")
 }
 
+// A flag that can be given more than once, like --exclude
+type stringListFlag []string
+
+func (list *stringListFlag) String() string {
+	return strings.Join(*list, ", ")
+}
+
+func (list *stringListFlag) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
 func main() {
 	h := flag.Bool("help", false, "display this help and exit")
 	v := flag.Bool("version", false, "output version information and exit")
 	ignoreHiddenFiles := flag.Bool("ignore-hidden-files", false, "ignore files and folders starting with '.'")
+	var excludes, excludeFrom stringListFlag
+	flag.Var(&excludes, "exclude", "skip files and folders matching the gitignore-style `PATTERN`, can be given more than once")
+	flag.Var(&excludeFrom, "exclude-from", "skip files and folders matching the gitignore-style patterns in `FILE`, can be given more than once")
+	minSize := flag.String("min-size", "", "only count files of at least `SIZE`, like 500M or 1GiB")
+	maxSize := flag.String("max-size", "", "only count files of at most `SIZE`")
+	olderThan := flag.String("older-than", "", "only count files not changed in `AGE`, like 90d, 2w, 1y or 12h")
+	newerThan := flag.String("newer-than", "", "only count files changed within `AGE`")
+	timeField := flag.String("time", "mtime", "the time --older-than and --newer-than use: "+strings.Join(timeFieldNames, ", "))
+	diffFlag := flag.String("diff", "", "compare the results against the search saved in `FILE` with --save, in the Diff tab")
+	diffSort := flag.String("diff-sort", "size", "sort the differences by the change in: "+strings.Join(diffSortNames, ", "))
+	save := flag.String("save", "", "search, then save the results to `FILE` to open later with --load")
+	load := flag.String("load", "", "open the results saved in `FILE` with --save, or an ncdu JSON export, instead of searching")
+	exportNcdu := flag.String("export-ncdu", "", "search, then write the results to `FILE` as an ncdu JSON export, to open with ncdu -f")
+	archives := flag.Bool("archives", false, "look inside tar, tar.gz and zip files, they can be opened like folders")
+	diskUsage := flag.Bool("disk-usage", false, "use the allocated disk space instead of the apparent size, like du")
+	oneFileSystem := flag.Bool("one-file-system", false, "don't descend into folders on other filesystems")
+	jobs := flag.Int("jobs", runtime.NumCPU(), "amount of folders to read in parallel")
 	maxCount := flag.Int("max-file-count", 150, "max amount of files/folders to output")
 	outputFiles := flag.Bool("output-files", false, "output to stdout, biggest filesize first, filenames with newlines omitted")
-	outputDirs := flag.Bool("output-dirs", false, "output to stdout, biggest sum filesize first, paths with newlines omitted")
+	outputDirs := flag.Bool("output-dirs", false, "output to stdout, biggest cumulative folder size first (like du), paths with newlines omitted")
 	outputPackages := flag.Bool("output-packages", false, "output to stdout, biggest estimated filesize first")
+	outputErrors := flag.Bool("output-errors", false, "output the files and folders that could not be read to stderr")
+	format := flag.String("format", "text", "output format of --output-files, --output-dirs and --output-packages: "+strings.Join(outputFormats, ", "))
+	columnsFlag := flag.String("columns", "", "comma-separated columns of the text, csv and tsv formats: "+strings.Join(outputColumns, ", ")+" (default \"path\" for text, \"size,path\" for csv and tsv)")
+	bytes := flag.Bool("bytes", false, "write sizes in the text, csv and tsv formats in bytes, adds a size column to the text format, same as --block-size=1")
+	human := flag.Bool("human", false, "write sizes in the text, csv and tsv formats like \"1.5 MB\" in the --units, adds a size column to the text format")
+	blockSizeFlag := flag.String("block-size", "", "write sizes in the text, csv and tsv formats in units of SIZE, like du (1, K, MB, 4KiB, si, human-readable), adds a size column to the text format")
+	unitsFlag := flag.String("units", "si", "units of the shown sizes: si (kB, MB), iec (KiB, MiB) or raw (bytes)")
+	precision := flag.Int("precision", 3, "max amount of decimals in the shown sizes, rounded")
+	null := flag.Bool("null", false, "end every line of the text format with NUL instead of newline, for xargs -0")
 
 	getopt.CommandLine.SetOutput(os.Stdout)
 	getopt.CommandLine.Init(programName, flag.ExitOnError)
@@ -39,6 +81,11 @@ func main() {
 		"i", "ignore-hidden-files",
 		"c", "max-file-count",
 		"o", "output-files",
+		"x", "one-file-system",
+		"j", "jobs",
+		"0", "null",
+		"b", "bytes",
+		"B", "block-size",
 	)
 
 	err := getopt.CommandLine.Parse(os.Args[1:])
@@ -53,6 +100,7 @@ func main() {
 
 	if *h {
 		fmt.Println("Usage: " + filepath.Base(os.Args[0]) + " [OPTIONS] [FILES]")
+		fmt.Println("  or:  " + filepath.Base(os.Args[0]) + " [OPTIONS] diff OLD_SNAPSHOT NEW_SNAPSHOT_OR_FOLDER")
 		fmt.Println("Find biggest regular files")
 		fmt.Println()
 		getopt.PrintDefaults()
@@ -61,32 +109,119 @@ func main() {
 
 	fssize := NewFSSize()
 	fssize.ignoreHiddenFiles = *ignoreHiddenFiles
+	fssize.diskUsage = *diskUsage
+	fssize.archives = *archives
+	fssize.oneFileSystem = *oneFileSystem
+	fssize.jobs = max(1, *jobs)
 	if *maxCount <= 0 {
 		os.Exit(0)
 	}
 	fssize.maxCount = *maxCount
 
-	path := "/"
-	if len(getopt.CommandLine.Args()) > 0 {
-		path = getopt.CommandLine.Arg(0)
+	fssize.units, err = ParseUnitSystem(*unitsFlag)
+	if err != nil {
+		printError(err.Error())
+		os.Exit(1)
+	}
+	if *precision < 0 {
+		printError("--precision can not be negative")
+		os.Exit(1)
 	}
+	fssize.precision = *precision
+
+	// "fssize diff OLD NEW" compares two snapshots, or a snapshot and a folder searched now
+	args := getopt.CommandLine.Args()
+	diffMode := len(args) > 0 && args[0] == "diff"
+	if diffMode {
+		if len(args) != 3 {
+			printError("Usage: " + programName + " diff OLD_SNAPSHOT NEW_SNAPSHOT_OR_FOLDER")
+			os.Exit(1)
+		}
 
-	abs, err := filepath.Abs(path)
-	if err == nil {
-		path = abs
+		*diffFlag = args[1]
+		if info, err := os.Stat(args[2]); err == nil && !info.IsDir() {
+			*load = args[2]
+			args = nil
+		} else {
+			args = args[2:]
+		}
 	}
 
-	stat, err := os.Stat(path)
-	if err != nil {
-		fmt.Println("No such directory: " + path)
+	if !slices.Contains(diffSortNames, *diffSort) {
+		printError("Invalid --diff-sort \"" + *diffSort + "\", must be one of: " + strings.Join(diffSortNames, ", "))
 		os.Exit(1)
 	}
-	if !stat.IsDir() {
-		fmt.Println("Not a directory: " + path)
+	fssize.diffByPercent = *diffSort == "percent"
+
+	if *load != "" && len(args) > 0 {
+		printError("A folder to search can't be given together with --load")
 		os.Exit(1)
 	}
 
-	fssize.rootFolderPath = path
+	if *load == "" {
+		path := "/"
+		if len(args) > 0 {
+			path = args[0]
+		}
+
+		abs, err := filepath.Abs(path)
+		if err == nil {
+			path = abs
+		}
+
+		stat, err := os.Stat(path)
+		if err != nil {
+			fmt.Println("No such directory: " + path)
+			os.Exit(1)
+		}
+		if !stat.IsDir() {
+			fmt.Println("Not a directory: " + path)
+			os.Exit(1)
+		}
+
+		fssize.rootFolderPath = path
+	}
+
+	// The filter flags use the same syntax as the filter bar
+	filterSpec := ""
+	for _, f := range []struct{ key, value string }{{"min-size", *minSize}, {"max-size", *maxSize}, {"older-than", *olderThan}, {"newer-than", *newerThan}} {
+		if f.value != "" {
+			filterSpec += f.key + "=" + f.value + " "
+		}
+	}
+	if *timeField != "mtime" {
+		filterSpec += "time=" + *timeField
+	}
+	fssize.filter, err = ParseFilter(filterSpec)
+	if err != nil {
+		printError("Invalid filter: " + err.Error())
+		os.Exit(1)
+	}
+
+	if *load != "" {
+		if err := fssize.LoadSnapshot(*load); err != nil {
+			printError("Failed to load snapshot: " + err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if *diffFlag != "" {
+		if err := fssize.LoadDiffSnapshot(*diffFlag); err != nil {
+			printError("Failed to load snapshot to compare with: " + err.Error())
+			os.Exit(1)
+		}
+	}
+
+	for _, excludeFile := range excludeFrom {
+		if err := fssize.LoadExcludeFile(excludeFile); err != nil {
+			printError("Failed to read --exclude-from file: " + err.Error())
+			os.Exit(1)
+		}
+	}
+	for _, exclude := range excludes {
+		fssize.AddExclude(exclude)
+	}
+	fssize.LoadMounts()
 
 	btoi := func(b bool) int {
 		if b {
@@ -99,26 +234,112 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *outputFiles || *outputDirs || *outputPackages {
-		if *outputPackages {
-			fssize.AccumulatePackages()
+	if !slices.Contains(outputFormats, *format) {
+		printError("Invalid --format \"" + *format + "\", must be one of: " + strings.Join(outputFormats, ", "))
+		os.Exit(1)
+	}
+
+	if *null && *format != "text" {
+		printError("--null (-0) can only be used with --format text")
+		os.Exit(1)
+	}
+
+	if btoi(*bytes)+btoi(*human)+btoi(*blockSizeFlag != "") > 1 {
+		printError("More than one of: --bytes (-b), --human or --block-size (-B) were set, pick one!")
+		os.Exit(1)
+	}
+
+	sizeFlagSet := *bytes || *human || *blockSizeFlag != ""
+	if *bytes {
+		*blockSizeFlag = "1"
+	} else if *human {
+		*blockSizeFlag = unitSystemNames[fssize.units]
+	} else if *blockSizeFlag == "" {
+		*blockSizeFlag = "1"
+	}
+
+	blockSize, err := ParseBlockSize(*blockSizeFlag)
+	if err != nil {
+		printError(err.Error())
+		os.Exit(1)
+	}
+	blockSize.precision = fssize.precision
+
+	if *columnsFlag == "" {
+		if *format == "text" && !sizeFlagSet {
+			*columnsFlag = "path"
 		} else {
-			fssize.AccumulateFilesAndFolders()
+			*columnsFlag = "size,path"
+		}
+	}
+
+	columns, err := ParseColumns(*columnsFlag)
+	if err != nil {
+		printError(err.Error())
+		os.Exit(1)
+	}
+
+	if *outputFiles || *outputDirs || *outputPackages || *outputErrors || *save != "" || *exportNcdu != "" || diffMode {
+		// Stop searching on Ctrl+C, and output what we found so far
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		if *outputPackages {
+			fssize.AccumulatePackages(ctx)
+		}
+		if (!*outputPackages || *save != "" || *exportNcdu != "") && *load == "" {
+			fssize.AccumulateFilesAndFolders(ctx, nil)
 		}
+		stop()
 
-		ptr := &fssize.files
-		if *outputDirs {
+		if *save != "" {
+			if err := fssize.SaveSnapshot(*save); err != nil {
+				printError("Failed to save snapshot: " + err.Error())
+				os.Exit(1)
+			}
+		}
+
+		if *exportNcdu != "" {
+			if err := fssize.ExportNcdu(*exportNcdu); err != nil {
+				printError("Failed to export: " + err.Error())
+				os.Exit(1)
+			}
+		}
+
+		// Only --save or --export-ncdu
+		if !*outputFiles && !*outputDirs && !*outputPackages && !*outputErrors && !diffMode {
+			os.Exit(0)
+		}
+
+		if diffMode {
+			// All of the differences, fssize.diff only has the biggest ones that fit in the Diff tab
+			var entries []DiffEntry
+			if fssize.root != nil {
+				entries = DiffTrees(fssize.diffOld, fssize.root, fssize.diffByPercent)
+			}
+
+			if err := WriteDiff(os.Stdout, entries, *format, blockSize, *null); err != nil {
+				printError(err.Error())
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+
+		var ptr *[]File
+		if *outputFiles && *format != "json" && *format != "ndjson" {
+			files := fssize.FilesOnDisk()
+			ptr = &files
+		} else if *outputFiles {
+			ptr = &fssize.files
+		} else if *outputDirs {
 			ptr = &fssize.folders
 		} else if *outputPackages {
 			ptr = &fssize.packages
+		} else {
+			ptr = &[]File{} // Only --output-errors
 		}
 
-		for _, e := range *ptr {
-			if strings.ContainsRune(e.path, '\n') {
-				printError("Path omitted for containing a newline: \"" + e.path + "\"")
-			} else {
-				fmt.Println(e.path)
-			}
+		if err := NewOutputWriter(fssize, *format, *outputPackages, columns, *null, blockSize).Write(os.Stdout, *ptr); err != nil {
+			printError(err.Error())
+			os.Exit(1)
 		}
 
 		if *outputPackages {
@@ -130,11 +351,19 @@ dpkg-query -Wf '${Installed-Size}\t${Package}\n' | sort -rn
 This outputs the estimated kibibyte (KiB) size of all packages`)
 		}
 
+		if *outputErrors {
+			fssize.PrintErrors()
+		}
+
 		os.Exit(0)
 	}
 
 	app := tview.NewApplication()
 	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if fssize.DialogOpen() {
+			return event
+		}
+
 		if event.Rune() == 'q' {
 			app.Stop()
 			return nil
@@ -149,22 +378,27 @@ This outputs the estimated kibibyte (KiB) size of all packages`)
 		return event
 	})
 
+	app.EnableMouse(true)
 	fssize.app = app
+	fssize.pages = tview.NewPages().AddPage("main", fssize, true, true)
 
-	fssize.AccumulatePackages()
-	go fssize.AccumulateFilesAndFolders()
+	fssize.AccumulatePackages(context.Background())
+	fssize.mutex.Lock()
+	fssize.LoadTrash()
+	fssize.mutex.Unlock()
+	if *load == "" {
+		fssize.StartScan(nil)
+	}
 
-	fssize.accumulating = true // Just to make sure the below goroutine doesn't quit early
+	// Redraw whenever the results change, but not more often than every 100ms while searching
 	go func() {
-		for fssize.accumulating {
-			time.Sleep(250 * time.Millisecond)
-			if fssize.currentTab != Packages {
-				app.QueueUpdateDraw(func() {})
-			}
+		for range fssize.changed {
+			app.QueueUpdateDraw(func() {})
+			time.Sleep(100 * time.Millisecond)
 		}
 	}()
 
-	if err := app.SetRoot(fssize, true).Run(); err != nil {
+	if err := app.SetRoot(fssize.pages, true).Run(); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type Mount struct {
+	mountPoint string
+	fsType     string
+	source     string // Like "/dev/sda1"
+	totalBytes int64
+	usedBytes  int64
+	freeBytes  int64 // Available to unprivileged users, like df
+}
+
+// Filesystems that don't use any disk space, or would be counted twice (overlay)
+var virtualFileSystems = []string{
+	"autofs",
+	"binfmt_misc",
+	"bpf",
+	"cgroup",
+	"cgroup2",
+	"configfs",
+	"debugfs",
+	"devpts",
+	"devtmpfs",
+	"efivarfs",
+	"hugetlbfs",
+	"mqueue",
+	"nsfs",
+	"overlay",
+	"proc",
+	"pstore",
+	"ramfs",
+	"securityfs",
+	"sysfs",
+	"tmpfs",
+	"tracefs",
+}
+
+func IsVirtualFileSystem(fsType string) bool {
+	return slices.Contains(virtualFileSystems, fsType) || strings.HasPrefix(fsType, "fuse.")
+}
+
+// The mount point in /proc/self/mountinfo has spaces, tabs, newlines and backslashes escaped as octal, like "\040"
+func unescapeMountInfo(str string) string {
+	var ret strings.Builder
+	for i := 0; i < len(str); i++ {
+		if str[i] == '\\' && i+3 < len(str) {
+			code, err := strconv.ParseUint(str[i+1:i+4], 8, 8)
+			if err == nil {
+				ret.WriteByte(byte(code))
+				i += 3
+				continue
+			}
+		}
+
+		ret.WriteByte(str[i])
+	}
+	return ret.String()
+}
+
+// Parses /proc/self/mountinfo, the format is described in the proc(5) man page
+// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func ReadMounts() ([]Mount, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var ret []Mount
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		// There can be any amount of optional fields before the "-" separator
+		separatorIndex := slices.Index(fields, "-")
+		if len(fields) < 5 || separatorIndex == -1 || separatorIndex+2 >= len(fields) {
+			continue
+		}
+
+		mount := Mount{
+			mountPoint: unescapeMountInfo(fields[4]),
+			fsType:     fields[separatorIndex+1],
+			source:     unescapeMountInfo(fields[separatorIndex+2]),
+		}
+
+		// A later mount on the same mount point hides the earlier one
+		ret = slices.DeleteFunc(ret, func(e Mount) bool {
+			return e.mountPoint == mount.mountPoint
+		})
+		ret = append(ret, mount)
+	}
+
+	return ret, scanner.Err()
+}
+
+// Fills in the capacity, used and free bytes
+func (mount *Mount) Statfs() error {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(mount.mountPoint, &stat); err != nil {
+		return err
+	}
+
+	mount.totalBytes = int64(stat.Blocks) * int64(stat.Bsize)
+	mount.usedBytes = int64(stat.Blocks-stat.Bfree) * int64(stat.Bsize)
+	mount.freeBytes = int64(stat.Bavail) * int64(stat.Bsize)
+	return nil
+}
+
+// How long the Mounts tab waits for statfs before showing the mounts that did answer
+const statfsTimeout = 2 * time.Second
+
+// Reads the mounts into fssize.allMounts, leaving out the virtual ones and remembering them so they can be skipped
+// The sizes are only read by StatMounts, since statfs can hang on an unreachable network filesystem
+func (fssize *FSSize) LoadMounts() error {
+	mounts, err := ReadMounts()
+	if err != nil {
+		return err
+	}
+
+	fssize.allMounts = nil
+	fssize.virtualMounts = make(map[string]bool)
+	for _, mount := range mounts {
+		if IsVirtualFileSystem(mount.fsType) {
+			fssize.virtualMounts[mount.mountPoint] = true
+			continue
+		}
+
+		fssize.allMounts = append(fssize.allMounts, mount)
+	}
+	return nil
+}
+
+// Reads the sizes of the mounts into fssize.mounts in the background, keeping only the ones on a real disk
+// Every mount is read in its own goroutine and shown as soon as it answers, so one that hangs doesn't hold up the others
+// Mounts that failed or haven't answered yet are tried again the next time this is called
+func (fssize *FSSize) StatMounts() {
+	fssize.mutex.Lock()
+	defer fssize.mutex.Unlock()
+
+	if fssize.statingMounts == nil {
+		fssize.statingMounts = make(map[string]bool)
+	}
+	fssize.mountsDeadline = time.Now().Add(statfsTimeout)
+
+	for _, mount := range fssize.allMounts {
+		alreadyRead := slices.ContainsFunc(fssize.mounts, func(e Mount) bool {
+			return e.mountPoint == mount.mountPoint
+		})
+		if alreadyRead || fssize.statingMounts[mount.mountPoint] {
+			continue
+		}
+
+		fssize.statingMounts[mount.mountPoint] = true
+		go func() {
+			err := mount.Statfs()
+
+			fssize.mutex.Lock()
+			delete(fssize.statingMounts, mount.mountPoint)
+			if err == nil && mount.totalBytes != 0 {
+				fssize.mounts = append(fssize.mounts, mount)
+				slices.SortStableFunc(fssize.mounts, func(a, b Mount) int {
+					if a.usedBytes < b.usedBytes {
+						return 1
+					} else if a.usedBytes > b.usedBytes {
+						return -1
+					}
+
+					return strings.Compare(a.mountPoint, b.mountPoint)
+				})
+			}
+			fssize.mutex.Unlock()
+			fssize.NotifyChanged()
+		}()
+	}
+
+	// Redraw once the timeout is over, to stop saying the mounts are being read
+	go func() {
+		time.Sleep(statfsTimeout)
+		fssize.NotifyChanged()
+	}()
+}
+
+// Returns the mount points statfs still hasn't answered for after statfsTimeout, sorted, expects the mutex to be locked
+func (fssize *FSSize) HungMounts() []string {
+	if time.Now().Before(fssize.mountsDeadline) {
+		return nil
+	}
+
+	var ret []string
+	for mountPoint := range fssize.statingMounts {
+		ret = append(ret, mountPoint)
+	}
+	slices.Sort(ret)
+	return ret
+}
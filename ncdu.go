@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The info object of a file or folder in an ncdu JSON export
+// https://dev.yorhel.nl/ncdu/jsonfmt
+type NcduEntry struct {
+	Name      string `json:"name"`
+	Asize     int64  `json:"asize,omitempty"`
+	Dsize     int64  `json:"dsize,omitempty"`
+	Dev       uint64 `json:"dev,omitempty"`
+	Ino       uint64 `json:"ino,omitempty"`
+	Hlnkc     bool   `json:"hlnkc,omitempty"`
+	Nlink     uint64 `json:"nlink,omitempty"`
+	ReadError bool   `json:"read_error,omitempty"`
+	Excluded  string `json:"excluded,omitempty"`
+	Notreg    bool   `json:"notreg,omitempty"`
+	Uid       *int64 `json:"uid,omitempty"`
+	Mtime     *int64 `json:"mtime,omitempty"`
+}
+
+type ncduMetadata struct {
+	Progname  string `json:"progname"`
+	Progver   string `json:"progver"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Reads an ncdu JSON export into a snapshot
+// Like when searching, only regular files are counted and only the alphabetically first path of a hardlinked file, the other paths are marked as duplicates
+// The export is read one item at a time, so deep folders don't make it slower
+func ReadNcduExport(reader io.Reader) (*Snapshot, error) {
+	decoder := json.NewDecoder(reader)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return nil, errors.New("expected [majorver, minorver, metadata, directory]")
+	}
+
+	var majorVersion json.Number
+	if err := decoder.Decode(&majorVersion); err != nil || majorVersion != "1" {
+		return nil, errors.New("unsupported major version " + majorVersion.String() + ", only version 1 is supported")
+	}
+
+	var minorVersion json.Number
+	if err := decoder.Decode(&minorVersion); err != nil {
+		return nil, errors.New("invalid minor version: " + err.Error())
+	}
+
+	var metadata ncduMetadata
+	if err := decoder.Decode(&metadata); err != nil {
+		return nil, errors.New("invalid metadata: " + err.Error())
+	}
+
+	if !decoder.More() {
+		return nil, errors.New("expected [majorver, minorver, metadata, directory]")
+	}
+
+	snapshot := &Snapshot{
+		Format:    snapshotFormat,
+		Version:   snapshotVersion,
+		Timestamp: time.Unix(metadata.Timestamp, 0),
+		Errors:    []OutputError{},
+	}
+
+	hardlinks := make(map[Inode][]ncduHardlink)
+	var err error
+	snapshot.Tree, err = readNcduItem(decoder, "", 0, snapshot, hardlinks)
+	if err != nil {
+		return nil, err
+	}
+
+	if snapshot.Tree == nil || !snapshot.Tree.Dir {
+		return nil, errors.New("the top-level item is not a folder")
+	}
+	snapshot.Root = snapshot.Tree.Name
+
+	for _, links := range hardlinks {
+		slices.SortFunc(links, func(a, b ncduHardlink) int {
+			return strings.Compare(a.path, b.path)
+		})
+
+		for _, link := range links[1:] {
+			link.node.Duplicate = true
+		}
+	}
+
+	slices.SortFunc(snapshot.Errors, func(a, b OutputError) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return snapshot, nil
+}
+
+type ncduHardlink struct {
+	path string
+	node *SnapshotNode
+}
+
+// Reads the fields of an info object, after its opening '{' has been read
+func readNcduEntry(decoder *json.Decoder) (NcduEntry, error) {
+	var entry NcduEntry
+	fields := map[string]any{
+		"name":       &entry.Name,
+		"asize":      &entry.Asize,
+		"dsize":      &entry.Dsize,
+		"dev":        &entry.Dev,
+		"ino":        &entry.Ino,
+		"hlnkc":      &entry.Hlnkc,
+		"nlink":      &entry.Nlink,
+		"read_error": &entry.ReadError,
+		"excluded":   &entry.Excluded,
+		"notreg":     &entry.Notreg,
+		"uid":        &entry.Uid,
+		"mtime":      &entry.Mtime,
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return entry, err
+		}
+
+		// Fields we don't use, like gid and mode
+		var skipped json.RawMessage
+		field, ok := fields[token.(string)]
+		if !ok {
+			field = &skipped
+		}
+
+		if err := decoder.Decode(field); err != nil {
+			return entry, err
+		}
+	}
+
+	_, err := decoder.Token() // The closing '}'
+	return entry, err
+}
+
+// Skips the rest of an array, after its opening '[' has been read
+func skipNcduArray(decoder *json.Decoder) error {
+	for decoder.More() {
+		var skipped json.RawMessage
+		if err := decoder.Decode(&skipped); err != nil {
+			return err
+		}
+	}
+
+	_, err := decoder.Token() // The closing ']'
+	return err
+}
+
+// Folders are an array with the info object first followed by the items inside it, files are just the info object
+// Returns nil for items that aren't counted, like excluded folders and files that aren't regular files
+func readNcduItem(decoder *json.Decoder, parentPath string, parentDev uint64, snapshot *Snapshot, hardlinks map[Inode][]ncduHardlink) (*SnapshotNode, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	isDir := token == json.Delim('[')
+	if isDir {
+		if token, err = decoder.Token(); err != nil {
+			return nil, err
+		}
+	}
+
+	if token != json.Delim('{') {
+		return nil, errors.New("expected an info object, got " + fmt.Sprint(token))
+	}
+
+	entry, err := readNcduEntry(decoder)
+	if err != nil {
+		return nil, err
+	}
+
+	path := entry.Name
+	if parentPath != "" {
+		path = filepath.Join(parentPath, entry.Name)
+	}
+
+	if entry.Excluded != "" || entry.Notreg {
+		if isDir {
+			return nil, skipNcduArray(decoder)
+		}
+		return nil, nil
+	}
+
+	// Left out when it is the same as the folder containing it
+	if entry.Dev == 0 {
+		entry.Dev = parentDev
+	}
+
+	node := &SnapshotNode{Name: entry.Name, Dir: isDir, Dev: entry.Dev, Inode: entry.Ino, Links: entry.Nlink, NotRead: entry.ReadError}
+	if entry.Mtime != nil {
+		node.Mtime = *entry.Mtime
+		node.Atime = *entry.Mtime
+		node.Ctime = *entry.Mtime
+	}
+	if entry.Uid != nil {
+		node.Uid = uint32(*entry.Uid)
+	}
+
+	if entry.ReadError {
+		snapshot.Errors = append(snapshot.Errors, OutputError{Path: path, Error: "could not be read by ncdu"})
+	}
+
+	if !isDir {
+		node.Apparent = entry.Asize
+		node.Allocated = entry.Dsize
+		node.Links = max(entry.Nlink, 1) // Only written for hardlinked files
+		snapshot.Files++
+		snapshot.Bytes += entry.Asize
+
+		if entry.Hlnkc && parentPath != "" {
+			inode := Inode{device: entry.Dev, inode: entry.Ino}
+			hardlinks[inode] = append(hardlinks[inode], ncduHardlink{path: path, node: node})
+		}
+		return node, nil
+	}
+
+	snapshot.Folders++
+	for decoder.More() {
+		child, err := readNcduItem(decoder, path, entry.Dev, snapshot, hardlinks)
+		if err != nil {
+			return nil, err
+		}
+
+		if child != nil {
+			node.Children = append(node.Children, child)
+		}
+	}
+
+	_, err = decoder.Token() // The closing ']'
+	return node, err
+}
+
+// Writes the results as an ncdu JSON export, which can be opened with ncdu -f
+// Files not matching the filter are left out
+func (fssize *FSSize) ExportNcdu(path string) error {
+	fssize.mutex.Lock()
+	defer fssize.mutex.Unlock()
+
+	if fssize.root == nil {
+		return errors.New("nothing to export, the search didn't start")
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(file)
+	metadata, _ := json.Marshal(ncduMetadata{Progname: programName, Progver: strings.TrimPrefix(version, "v"), Timestamp: fssize.stats.startTime.Unix()})
+	out.WriteString("[1,2," + string(metadata) + ",\n")
+	writeNcduItem(out, fssize.root, 0)
+	out.WriteString("]\n")
+
+	if err := out.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// parentDev is the device of the folder containing node, the device is only written when it is different
+func writeNcduItem(out *bufio.Writer, node *Node, parentDev uint64) {
+	entry := NcduEntry{Name: node.name, Ino: node.inode, ReadError: node.notRead}
+	if node.device != parentDev {
+		entry.Dev = node.device
+	}
+	if node.mtime != 0 {
+		mtime := node.mtime
+		uid := int64(node.uid)
+		entry.Mtime = &mtime
+		entry.Uid = &uid
+	}
+
+	if !node.isDir {
+		entry.Asize = node.apparentSize
+		entry.Dsize = node.allocatedSize
+		if node.linkCount > 1 {
+			entry.Hlnkc = true
+			entry.Nlink = node.linkCount
+		}
+
+		info, _ := json.Marshal(entry)
+		out.Write(info)
+		return
+	}
+
+	info, _ := json.Marshal(entry)
+	out.WriteString("[")
+	out.Write(info)
+	for _, child := range node.children {
+		if child.hidden {
+			continue
+		}
+
+		out.WriteString(",\n")
+		writeNcduItem(out, child, node.device)
+	}
+	out.WriteString("]")
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Searches path like fssize does without the TUI
+func scanFolder(t *testing.T, path string) *FSSize {
+	t.Helper()
+	fssize := NewFSSize()
+	fssize.rootFolderPath = path
+	fssize.maxCount = 150
+	fssize.jobs = 2
+	if err := fssize.AccumulateFilesAndFolders(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	return fssize
+}
+
+// Writes the results with ExportNcdu and reads them back with ReadSnapshot
+func exportAndRead(t *testing.T, fssize *FSSize) *Snapshot {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "export.json")
+	if err := fssize.ExportNcdu(path); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := ReadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+// Compares everything an ncdu export keeps, the access and status change times are not in it
+func compareSnapshotNodes(t *testing.T, path string, want, got *SnapshotNode) {
+	t.Helper()
+	if got.Name != want.Name || got.Dir != want.Dir {
+		t.Errorf("%s: got name %q dir %v, want name %q dir %v", path, got.Name, got.Dir, want.Name, want.Dir)
+		return
+	}
+
+	if got.Apparent != want.Apparent || got.Allocated != want.Allocated {
+		t.Errorf("%s: got sizes %d/%d, want %d/%d", path, got.Apparent, got.Allocated, want.Apparent, want.Allocated)
+	}
+	if got.Mtime != want.Mtime || got.Uid != want.Uid {
+		t.Errorf("%s: got mtime %d uid %d, want mtime %d uid %d", path, got.Mtime, got.Uid, want.Mtime, want.Uid)
+	}
+	if got.Dev != want.Dev || got.Inode != want.Inode || got.Links != want.Links {
+		t.Errorf("%s: got dev %d inode %d links %d, want dev %d inode %d links %d", path, got.Dev, got.Inode, got.Links, want.Dev, want.Inode, want.Links)
+	}
+	if got.NotRead != want.NotRead || got.Duplicate != want.Duplicate {
+		t.Errorf("%s: got not_read %v duplicate %v, want not_read %v duplicate %v", path, got.NotRead, got.Duplicate, want.NotRead, want.Duplicate)
+	}
+
+	gotChildren := make(map[string]*SnapshotNode)
+	for _, child := range got.Children {
+		gotChildren[child.Name] = child
+	}
+	if len(got.Children) != len(want.Children) {
+		t.Errorf("%s: got %d children, want %d", path, len(got.Children), len(want.Children))
+	}
+
+	for _, wantChild := range want.Children {
+		gotChild, ok := gotChildren[wantChild.Name]
+		if !ok {
+			t.Errorf("%s: missing %q", path, wantChild.Name)
+			continue
+		}
+		compareSnapshotNodes(t, filepath.Join(path, wantChild.Name), wantChild, gotChild)
+	}
+}
+
+func TestNcduExportRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]int{
+		"big":              5000,
+		"sub/small":        10,
+		"sub/deeper/empty": 0,
+	}
+	for name, size := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Unix(1600000000+int64(size), 0)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// "big" comes first alphabetically, so the link is the one not counted
+	if err := os.Link(filepath.Join(dir, "big"), filepath.Join(dir, "sub", "z-link")); err != nil {
+		t.Fatal(err)
+	}
+
+	fssize := scanFolder(t, dir)
+
+	// Folders can't be made unreadable when the tests run as root, so mark one by hand
+	fssize.root.Find(filepath.Join(dir, "sub", "deeper")).notRead = true
+	fssize.root.RecalculateTotals(NoFilter())
+
+	snapshot := exportAndRead(t, fssize)
+	compareSnapshotNodes(t, dir, NewSnapshotNode(fssize.root), snapshot.Tree)
+
+	if snapshot.Root != dir {
+		t.Errorf("got root %q, want %q", snapshot.Root, dir)
+	}
+	if !snapshot.Timestamp.Equal(fssize.stats.startTime.Truncate(time.Second)) {
+		t.Errorf("got timestamp %v, want %v", snapshot.Timestamp, fssize.stats.startTime)
+	}
+	if len(snapshot.Errors) != 1 || snapshot.Errors[0].Path != filepath.Join(dir, "sub", "deeper") {
+		t.Errorf("got errors %v, want only %s", snapshot.Errors, filepath.Join(dir, "sub", "deeper"))
+	}
+
+	link := fssize.root.Find(filepath.Join(dir, "sub", "z-link"))
+	if link == nil || !link.duplicateLink {
+		t.Fatal("the second hardlink should be kept in the tree as a duplicate")
+	}
+
+	loaded := snapshot.Tree.Node(nil, false)
+	loaded.RecalculateTotals(NoFilter())
+	if loaded.totalSize != fssize.root.totalSize || loaded.apparentSize != fssize.root.apparentSize || loaded.allocatedSize != fssize.root.allocatedSize {
+		t.Errorf("got sizes %d/%d/%d, want %d/%d/%d", loaded.totalSize, loaded.apparentSize, loaded.allocatedSize, fssize.root.totalSize, fssize.root.apparentSize, fssize.root.allocatedSize)
+	}
+	if loaded.totalSize != 5010 {
+		t.Errorf("got total size %d, want 5010 with the hardlink counted once", loaded.totalSize)
+	}
+	if !loaded.incomplete {
+		t.Error("the folder that couldn't be read should make the root incomplete")
+	}
+}
+
+// testdata/ncdu-export.json is in the format of ncdu 1.18 -e -o, see https://dev.yorhel.nl/ncdu/jsonfmt
+func TestReadNcduExport(t *testing.T) {
+	snapshot, err := ReadSnapshot(filepath.Join("testdata", "ncdu-export.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if snapshot.Root != "/srv/data" || snapshot.Timestamp.Unix() != 1700000000 {
+		t.Errorf("got root %q timestamp %d", snapshot.Root, snapshot.Timestamp.Unix())
+	}
+	if len(snapshot.Errors) != 1 || snapshot.Errors[0].Path != "/srv/data/private" {
+		t.Errorf("got errors %v, want only /srv/data/private", snapshot.Errors)
+	}
+
+	root := snapshot.Tree.Node(nil, false)
+	root.RecalculateTotals(NoFilter())
+
+	const wantSize = 52428800 + 1048576 + 3000000 + 7
+	if root.totalSize != wantSize {
+		t.Errorf("got total size %d, want %d", root.totalSize, wantSize)
+	}
+	if files, folders := root.Count(); files != 5 || folders != 4 {
+		t.Errorf("got %d files and %d folders, want 5 and 4", files, folders)
+	}
+	if !root.incomplete {
+		t.Error("the root should be incomplete, /srv/data/private couldn't be read")
+	}
+
+	// Hardlinks are the same file when both the device and the inode are the same, the device is inherited from the folder
+	tests := []struct {
+		path      string
+		device    uint64
+		duplicate bool
+	}{
+		{"backups/report.pdf", 2049, false},
+		{"report-link.pdf", 2049, true},
+		{"report.pdf", 2049, true},
+		{"backups/monday.tar", 2049, false},
+		{"usb/photo-copy.jpg", 2065, false},
+		{"usb/photo.jpg", 2065, true},
+		{"usb/same-ino-other-dev", 2065, false},
+	}
+	for _, test := range tests {
+		node := root.Find(filepath.Join("/srv/data", test.path))
+		if node == nil {
+			t.Errorf("%s: missing", test.path)
+			continue
+		}
+
+		if node.device != test.device || node.duplicateLink != test.duplicate {
+			t.Errorf("%s: got device %d duplicate %v, want device %d duplicate %v", test.path, node.device, node.duplicateLink, test.device, test.duplicate)
+		}
+	}
+
+	monday := root.Find("/srv/data/backups/monday.tar")
+	if monday != nil && (monday.mtime != 1699800000 || monday.uid != 1000 || monday.allocatedSize != 52432896) {
+		t.Errorf("backups/monday.tar: got mtime %d uid %d allocated %d", monday.mtime, monday.uid, monday.allocatedSize)
+	}
+
+	for _, path := range []string{"node_modules", "proc", "backups/socket"} {
+		if root.Find(filepath.Join("/srv/data", path)) != nil {
+			t.Errorf("%s: excluded and not regular files should be left out", path)
+		}
+	}
+
+	if private := root.Find("/srv/data/private"); private == nil || !private.notRead {
+		t.Error("private: should be marked as not read")
+	}
+}
+
+// Loading an export written by ncdu and exporting it again keeps everything, including the hardlinks on the other device
+func TestNcduExportAgain(t *testing.T) {
+	path := filepath.Join("testdata", "ncdu-export.json")
+	want, err := ReadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fssize := NewFSSize()
+	fssize.maxCount = 150
+	if err := fssize.LoadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	got := exportAndRead(t, fssize)
+	compareSnapshotNodes(t, want.Root, want.Tree, got.Tree)
+
+	if len(got.Errors) != len(want.Errors) {
+		t.Errorf("got errors %v, want %v", got.Errors, want.Errors)
+	}
+	if !got.Timestamp.Equal(want.Timestamp) {
+		t.Errorf("got timestamp %v, want %v", got.Timestamp, want.Timestamp)
+	}
+}
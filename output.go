@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var outputFormats = []string{"text", "json", "ndjson", "csv", "tsv"}
+
+// The columns that can be picked with --columns for the text, csv and tsv formats
+var outputColumns = []string{"size", "path", "mtime", "owner", "apparent_size", "allocated_size", "type"}
+
+// One file, folder or package in the json and ndjson output
+type OutputEntry struct {
+	Path          string `json:"path"`
+	ApparentSize  int64  `json:"apparent_size"`
+	AllocatedSize int64  `json:"allocated_size"`
+	Mtime         string `json:"mtime,omitempty"`
+	Owner         string `json:"owner,omitempty"`
+	Type          string `json:"type"`
+	Archive       string `json:"archive,omitempty"` // Only set for files and folders inside an archive, which have no path on disk
+}
+
+type OutputTotals struct {
+	ApparentSize  int64 `json:"apparent_size"`
+	AllocatedSize int64 `json:"allocated_size"`
+	Files         int64 `json:"files"`
+	Folders       int64 `json:"folders"`
+}
+
+type OutputError struct {
+	Path    string `json:"path"`
+	Error   string `json:"error"`
+	Archive bool   `json:"archive,omitempty"` // Couldn't look inside the archive, its size on disk is still counted
+}
+
+// The top-level json object, ndjson outputs this without the entries as the last line
+type OutputSummary struct {
+	Type      string        `json:"type,omitempty"` // Only set in ndjson, to tell the summary apart from the entries
+	Root      string        `json:"root"`
+	Timestamp string        `json:"timestamp"`
+	Totals    OutputTotals  `json:"totals"`
+	Errors    []OutputError `json:"errors"`
+	Entries   []OutputEntry `json:"entries,omitempty"`
+}
+
+// Writes the search results in one of outputFormats
+type OutputWriter struct {
+	fssize    *FSSize
+	format    string
+	packages  bool      // The files are packages, they have no path on disk
+	columns   []string  // Only used for text, csv and tsv
+	null      bool      // Only used for text, end every line with NUL instead of newline
+	blockSize BlockSize // Only used for text, csv and tsv
+	owners    map[uint32]string
+}
+
+func NewOutputWriter(fssize *FSSize, format string, packages bool, columns []string, null bool, blockSize BlockSize) *OutputWriter {
+	return &OutputWriter{fssize: fssize, format: format, packages: packages, columns: columns, null: null, blockSize: blockSize, owners: make(map[uint32]string)}
+}
+
+// Parses a comma-separated list of outputColumns, like "size,path"
+func ParseColumns(str string) ([]string, error) {
+	columns := strings.Split(str, ",")
+	for _, column := range columns {
+		if !slices.Contains(outputColumns, column) {
+			return nil, errors.New("Invalid column \"" + column + "\", must be one of: " + strings.Join(outputColumns, ", "))
+		}
+	}
+	return columns, nil
+}
+
+// Returns the username of uid, or the uid as a string if it has no user
+func (writer *OutputWriter) Owner(uid uint32) string {
+	if owner, ok := writer.owners[uid]; ok {
+		return owner
+	}
+
+	owner := strconv.FormatUint(uint64(uid), 10)
+	if u, err := user.LookupId(owner); err == nil {
+		owner = u.Username
+	}
+	writer.owners[uid] = owner
+	return owner
+}
+
+func (writer *OutputWriter) Entry(file File) OutputEntry {
+	if writer.packages {
+		return OutputEntry{Path: file.path, ApparentSize: file.sizeBytes, AllocatedSize: file.sizeBytes, Type: "package"}
+	}
+
+	entry := OutputEntry{
+		Path:          file.path,
+		ApparentSize:  file.apparentBytes,
+		AllocatedSize: file.allocatedBytes,
+		Mtime:         time.Unix(file.mtime, 0).Format(time.RFC3339),
+		Owner:         writer.Owner(file.uid),
+		Type:          "file",
+	}
+	if file.isDir {
+		entry.Type = "directory"
+	}
+	if file.virtual {
+		entry.Type = "archive_member"
+		entry.Archive = file.archivePath
+	}
+	return entry
+}
+
+// Returns the value of one of outputColumns for the text, csv and tsv formats
+func (writer *OutputWriter) Column(file File, entry OutputEntry, column string) string {
+	switch column {
+	case "size":
+		return writer.blockSize.Format(file.sizeBytes)
+	case "path":
+		return entry.Path
+	case "mtime":
+		return entry.Mtime
+	case "owner":
+		return entry.Owner
+	case "apparent_size":
+		return writer.blockSize.Format(entry.ApparentSize)
+	case "allocated_size":
+		return writer.blockSize.Format(entry.AllocatedSize)
+	case "type":
+		return entry.Type
+	}
+
+	panic("unknown output column: " + column)
+}
+
+func (writer *OutputWriter) Summary() OutputSummary {
+	fssize := writer.fssize
+	summary := OutputSummary{
+		Root:      fssize.rootFolderPath,
+		Timestamp: fssize.stats.startTime.Format(time.RFC3339),
+		Errors:    []OutputError{},
+	}
+
+	if writer.packages {
+		summary.Root = ""
+		for _, file := range fssize.packages {
+			summary.Totals.ApparentSize += file.sizeBytes
+		}
+		summary.Totals.AllocatedSize = summary.Totals.ApparentSize
+	} else if fssize.root != nil {
+		// Counted from the tree like the sizes, so duplicate hardlinks and files not matching the filter are left out
+		summary.Totals.Files, summary.Totals.Folders = fssize.root.Count()
+		summary.Totals.ApparentSize = fssize.root.apparentSize
+		summary.Totals.AllocatedSize = fssize.root.allocatedSize
+	}
+
+	for _, scanError := range fssize.scanErrors {
+		summary.Errors = append(summary.Errors, OutputError{Path: scanError.path, Error: scanError.Message(), Archive: scanError.archive})
+	}
+	return summary
+}
+
+// The files inside archives are only in the json and ndjson output, marked as "archive_member"
+// The other formats are a list of paths on disk for things like xargs -0 rm, so they are given FSSize.FilesOnDisk
+func (writer *OutputWriter) Write(w io.Writer, files []File) error {
+	out := bufio.NewWriter(w)
+
+	switch writer.format {
+	case "json":
+		summary := writer.Summary()
+		summary.Entries = []OutputEntry{}
+		for _, file := range files {
+			summary.Entries = append(summary.Entries, writer.Entry(file))
+		}
+
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(summary); err != nil {
+			return err
+		}
+	case "ndjson":
+		encoder := json.NewEncoder(out)
+		for _, file := range files {
+			if err := encoder.Encode(writer.Entry(file)); err != nil {
+				return err
+			}
+		}
+
+		summary := writer.Summary()
+		summary.Type = "summary"
+		if err := encoder.Encode(summary); err != nil {
+			return err
+		}
+	case "csv", "tsv":
+		csvWriter := csv.NewWriter(out)
+		if writer.format == "tsv" {
+			csvWriter.Comma = '\t'
+		}
+
+		// Fields containing the separator, quotes or newlines are quoted
+		csvWriter.Write(writer.columns)
+		record := make([]string, len(writer.columns))
+		for _, file := range files {
+			entry := writer.Entry(file)
+			for i, column := range writer.columns {
+				record[i] = writer.Column(file, entry, column)
+			}
+			csvWriter.Write(record)
+		}
+
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return err
+		}
+	default:
+		// Columns are separated by tabs, like du
+		fields := make([]string, len(writer.columns))
+		for _, file := range files {
+			entry := writer.Entry(file)
+			for i, column := range writer.columns {
+				fields[i] = writer.Column(file, entry, column)
+			}
+			line := strings.Join(fields, "\t")
+
+			if writer.null {
+				out.WriteString(line + "\x00")
+			} else if strings.ContainsRune(line, '\n') {
+				printError("Path omitted for containing a newline: \"" + file.path + "\", use --null (-0) or --format csv to include it")
+			} else {
+				out.WriteString(line + "\n")
+			}
+		}
+	}
+
+	return out.Flush()
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Increased whenever the snapshot format changes in a way older versions of fssize can't read
+const snapshotVersion = 1
+
+const snapshotFormat = "fssize-snapshot"
+
+// A saved search, written as gzip-compressed JSON by --save and read by --load
+type Snapshot struct {
+	Format    string        `json:"format"` // Always snapshotFormat, to recognize the file
+	Version   int           `json:"version"`
+	Root      string        `json:"root"`
+	Timestamp time.Time     `json:"timestamp"` // When the search started
+	Elapsed   float64       `json:"elapsed"`   // How long the search took, in seconds
+	Cancelled bool          `json:"cancelled,omitempty"`
+	Files     int64         `json:"files"`
+	Folders   int64         `json:"folders"`
+	Bytes     int64         `json:"bytes"`
+	Errors    []OutputError `json:"errors"`
+	Tree      *SnapshotNode `json:"tree"`
+}
+
+// The sizes of folders are not saved, they are calculated again from the files when loading
+type SnapshotNode struct {
+	Name      string          `json:"name"`
+	Dir       bool            `json:"dir,omitempty"`
+	Apparent  int64           `json:"apparent,omitempty"`
+	Allocated int64           `json:"allocated,omitempty"`
+	Mtime     int64           `json:"mtime"`
+	Atime     int64           `json:"atime"`
+	Ctime     int64           `json:"ctime"`
+	Uid       uint32          `json:"uid"`
+	Dev       uint64          `json:"dev,omitempty"`
+	Inode     uint64          `json:"inode"`
+	Links     uint64          `json:"links,omitempty"`
+	Duplicate bool            `json:"duplicate_link,omitempty"` // Another hardlink to the same file is counted instead
+	NotRead   bool            `json:"not_read,omitempty"`
+	Archive   bool            `json:"archive,omitempty"`
+	Virtual   bool            `json:"virtual,omitempty"`
+	Children  []*SnapshotNode `json:"children,omitempty"`
+}
+
+func NewSnapshotNode(node *Node) *SnapshotNode {
+	ret := &SnapshotNode{
+		Name:      node.name,
+		Dir:       node.isDir,
+		Mtime:     node.mtime,
+		Atime:     node.atime,
+		Ctime:     node.ctime,
+		Uid:       node.uid,
+		Dev:       node.device,
+		Inode:     node.inode,
+		Links:     node.linkCount,
+		Duplicate: node.duplicateLink,
+		NotRead:   node.notRead,
+		Archive:   node.archive,
+		Virtual:   node.virtual,
+	}
+
+	if !node.isDir {
+		ret.Apparent = node.apparentSize
+		ret.Allocated = node.allocatedSize
+	}
+
+	for _, child := range node.children {
+		ret.Children = append(ret.Children, NewSnapshotNode(child))
+	}
+	return ret
+}
+
+// Returns the node with its parent set, the folder sizes still need to be calculated with RecalculateTotals
+func (snapshotNode *SnapshotNode) Node(parent *Node, diskUsage bool) *Node {
+	node := &Node{
+		name:          snapshotNode.Name,
+		parent:        parent,
+		isDir:         snapshotNode.Dir,
+		apparentSize:  snapshotNode.Apparent,
+		allocatedSize: snapshotNode.Allocated,
+		notRead:       snapshotNode.NotRead,
+		mtime:         snapshotNode.Mtime,
+		atime:         snapshotNode.Atime,
+		ctime:         snapshotNode.Ctime,
+		uid:           snapshotNode.Uid,
+		device:        snapshotNode.Dev,
+		inode:         snapshotNode.Inode,
+		linkCount:     snapshotNode.Links,
+		duplicateLink: snapshotNode.Duplicate,
+		archive:       snapshotNode.Archive,
+		virtual:       snapshotNode.Virtual,
+	}
+
+	if !node.isDir {
+		node.totalSize = node.apparentSize
+		if diskUsage {
+			node.totalSize = node.allocatedSize
+		}
+		node.ownSize = node.totalSize
+	}
+
+	for _, child := range snapshotNode.Children {
+		node.children = append(node.children, child.Node(node, diskUsage))
+	}
+	return node
+}
+
+// Writes the results of the last search to path, replacing the file atomically
+func (fssize *FSSize) SaveSnapshot(path string) error {
+	fssize.mutex.Lock()
+	defer fssize.mutex.Unlock()
+
+	if fssize.root == nil {
+		return errors.New("nothing to save, the search didn't start")
+	}
+
+	snapshot := Snapshot{
+		Format:    snapshotFormat,
+		Version:   snapshotVersion,
+		Root:      fssize.rootFolderPath,
+		Timestamp: fssize.stats.startTime,
+		Elapsed:   fssize.stats.Elapsed().Seconds(),
+		Cancelled: fssize.cancelled,
+		Files:     fssize.stats.files.Load(),
+		Folders:   fssize.stats.folders.Load(),
+		Bytes:     fssize.stats.bytes.Load(),
+		Errors:    []OutputError{},
+		Tree:      NewSnapshotNode(fssize.root),
+	}
+	for _, scanError := range fssize.scanErrors {
+		snapshot.Errors = append(snapshot.Errors, OutputError{Path: scanError.path, Error: scanError.Message(), Archive: scanError.archive})
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	// CreateTemp only lets the owner read it
+	if err := file.Chmod(0o644); err != nil {
+		file.Close()
+		return err
+	}
+
+	writer := gzip.NewWriter(file)
+	if err := json.NewEncoder(writer).Encode(snapshot); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// Replaces the results with a snapshot written by SaveSnapshot, without reading the filesystem
+func (fssize *FSSize) LoadSnapshot(path string) error {
+	snapshot, err := ReadSnapshot(path)
+	if err != nil {
+		return err
+	}
+
+	stats := NewScanStats()
+	stats.startTime = snapshot.Timestamp
+	stats.files.Store(snapshot.Files)
+	stats.folders.Store(snapshot.Folders)
+	stats.bytes.Store(snapshot.Bytes)
+	endTime := snapshot.Timestamp.Add(time.Duration(snapshot.Elapsed * float64(time.Second)))
+	stats.endTime.Store(&endTime)
+
+	fssize.mutex.Lock()
+	defer fssize.mutex.Unlock()
+
+	fssize.snapshotPath = path
+	fssize.rootFolderPath = snapshot.Root
+	fssize.stats = stats
+	fssize.cancelled = snapshot.Cancelled
+	fssize.scanErrors = nil
+	for _, scanError := range snapshot.Errors {
+		fssize.scanErrors = append(fssize.scanErrors, ScanError{path: scanError.Path, err: errors.New(scanError.Error), archive: scanError.Archive})
+	}
+
+	fssize.root = snapshot.Tree.Node(nil, fssize.diskUsage)
+	fssize.root.RecalculateTotals(fssize.filter)
+	fssize.RebuildLists()
+	return nil
+}
+
+// Reads a snapshot written by SaveSnapshot, or an ncdu JSON export (ncdu -o), either of them optionally gzip-compressed
+func ReadSnapshot(path string) (*Snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	if magic, _ := reader.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, errors.New(path + " is not an fssize snapshot: " + err.Error())
+		}
+		defer gzipReader.Close()
+		reader = bufio.NewReader(gzipReader)
+	}
+
+	// ncdu exports are a JSON array, our snapshots are an object
+	if firstByte(reader) == '[' {
+		snapshot, err := ReadNcduExport(reader)
+		if err != nil {
+			return nil, errors.New(path + " is not a valid ncdu export: " + err.Error())
+		}
+		return snapshot, nil
+	}
+
+	var snapshot Snapshot
+	if err := json.NewDecoder(reader).Decode(&snapshot); err != nil {
+		return nil, errors.New(path + " is not an fssize snapshot: " + err.Error())
+	}
+
+	if snapshot.Format != snapshotFormat {
+		return nil, errors.New(path + " is not an fssize snapshot")
+	}
+
+	if snapshot.Version > snapshotVersion {
+		return nil, errors.New(path + " is a version " + strconv.Itoa(snapshot.Version) + " snapshot, but this version of fssize can only read up to version " + strconv.Itoa(snapshotVersion))
+	}
+
+	if snapshot.Tree == nil {
+		return nil, errors.New(path + " has no directory tree")
+	}
+	return &snapshot, nil
+}
+
+// Returns the first byte that isn't whitespace without consuming it, or 0 if there is none
+func firstByte(reader *bufio.Reader) byte {
+	for i := 1; ; i++ {
+		peeked, err := reader.Peek(i)
+		if len(peeked) < i {
+			return 0
+		}
+
+		c := peeked[i-1]
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			return c
+		}
+
+		if err != nil {
+			return 0
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Progress of a search, updated by the walker goroutines while reading
+type ScanStats struct {
+	files            atomic.Int64
+	folders          atomic.Int64
+	bytes            atomic.Int64
+	permissionErrors atomic.Int64
+	currentFolder    atomic.Pointer[string] // The folder read most recently
+	startTime        time.Time
+	endTime          atomic.Pointer[time.Time] // nil until the search has finished
+}
+
+func NewScanStats() *ScanStats {
+	return &ScanStats{startTime: time.Now()}
+}
+
+func (stats *ScanStats) Finish() {
+	now := time.Now()
+	stats.endTime.Store(&now)
+}
+
+func (stats *ScanStats) Elapsed() time.Duration {
+	if endTime := stats.endTime.Load(); endTime != nil {
+		return endTime.Sub(stats.startTime)
+	}
+
+	return time.Since(stats.startTime)
+}
+
+func (stats *ScanStats) CurrentFolder() string {
+	if path := stats.currentFolder.Load(); path != nil {
+		return *path
+	}
+
+	return ""
+}
+
+// Like "1234 files, 56 folders, 1.2 GB, 800 files/s, 2s, 3 permission errors"
+func (stats *ScanStats) String(units UnitSystem, precision int) string {
+	files := stats.files.Load()
+	elapsed := stats.Elapsed()
+
+	ret := strconv.FormatInt(files, 10) + " files, " + strconv.FormatInt(stats.folders.Load(), 10) + " folders, " + BytesToHumanReadableUnitString(uint64(stats.bytes.Load()), units, precision)
+	if elapsed >= time.Second {
+		ret += ", " + strconv.FormatInt(int64(float64(files)/elapsed.Seconds()), 10) + " files/s"
+	}
+	ret += ", " + elapsed.Round(time.Second).String()
+
+	if permissionErrors := stats.permissionErrors.Load(); permissionErrors > 0 {
+		ret += ", " + strconv.FormatInt(permissionErrors, 10) + " permission errors"
+	}
+	return ret
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Moving files to the trash as described in the freedesktop.org Trash specification
+// https://specifications.freedesktop.org/trash-spec/1.0/
+
+const trashInfoDateFormat = "2006-01-02T15:04:05"
+
+type TrashedFile struct {
+	trashDir     string // The folder containing the "files" and "info" folders
+	name         string // The name inside trashDir/files
+	originalPath string
+	deletionDate time.Time
+	sizeBytes    int64
+	isDir        bool
+}
+
+func (trashed *TrashedFile) FilesPath() string {
+	return filepath.Join(trashed.trashDir, "files", trashed.name)
+}
+
+func (trashed *TrashedFile) InfoPath() string {
+	return filepath.Join(trashed.trashDir, "info", trashed.name+".trashinfo")
+}
+
+// $XDG_DATA_HOME/Trash, which defaults to ~/.local/share/Trash
+func HomeTrashDir() (string, error) {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+
+	return filepath.Join(dataHome, "Trash"), nil
+}
+
+// Returns the top folder of the filesystem path is on, like "/" or "/media/usb"
+func MountTopDir(path string) (string, error) {
+	dev, err := deviceOf(path)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path, nil
+		}
+
+		parentDev, err := deviceOf(parent)
+		if err != nil {
+			return "", err
+		}
+
+		if parentDev != dev {
+			return path, nil
+		}
+		path = parent
+	}
+}
+
+// Returns the trash folder to use for path, the home trash if it is on the same filesystem, otherwise $topdir/.Trash-$uid
+// The returned topDir is empty when the home trash should be used, since it stores absolute paths
+func TrashDirFor(path string) (trashDir string, topDir string, err error) {
+	homeTrash, err := HomeTrashDir()
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := os.MkdirAll(homeTrash, 0700); err != nil {
+		return "", "", err
+	}
+
+	homeTrashDev, err := deviceOf(homeTrash)
+	if err != nil {
+		return "", "", err
+	}
+
+	dev, err := deviceOf(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	if dev == homeTrashDev {
+		return homeTrash, "", nil
+	}
+
+	topDir, err = MountTopDir(path)
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(topDir, ".Trash-"+strconv.Itoa(os.Getuid())), topDir, nil
+}
+
+// Moves path to the trash, writing the .trashinfo file first as the spec requires
+func MoveToTrash(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	trashDir, topDir, err := TrashDirFor(path)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range []string{filepath.Join(trashDir, "files"), filepath.Join(trashDir, "info")} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	pathInInfo := path
+	if topDir != "" {
+		pathInInfo, err = filepath.Rel(topDir, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Find a free name by creating the .trashinfo file atomically, adding a number on collisions like "file.2"
+	baseName := filepath.Base(path)
+	var trashed TrashedFile
+	var infoFile *os.File
+	for i := 1; ; i++ {
+		name := baseName
+		if i > 1 {
+			name += "." + strconv.Itoa(i)
+		}
+
+		trashed = TrashedFile{trashDir: trashDir, name: name}
+		infoFile, err = os.OpenFile(trashed.InfoPath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+
+	_, err = infoFile.WriteString("[Trash Info]\nPath=" + (&url.URL{Path: pathInInfo}).EscapedPath() + "\nDeletionDate=" + time.Now().Format(trashInfoDateFormat) + "\n")
+	closeErr := infoFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(trashed.InfoPath())
+		return err
+	}
+
+	if err := os.Rename(path, trashed.FilesPath()); err != nil {
+		os.Remove(trashed.InfoPath())
+		return err
+	}
+
+	return nil
+}
+
+func readTrashInfo(trashed *TrashedFile, topDir string) error {
+	file, err := os.Open(trashed.InfoPath())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if !found {
+			continue
+		}
+
+		switch key {
+		case "Path":
+			path, err := url.PathUnescape(value)
+			if err != nil {
+				return err
+			}
+
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(topDir, path)
+			}
+			trashed.originalPath = path
+		case "DeletionDate":
+			trashed.deletionDate, _ = time.ParseInLocation(trashInfoDateFormat, value, time.Local)
+		}
+	}
+
+	if trashed.originalPath == "" {
+		return errors.New("missing Path in " + trashed.InfoPath())
+	}
+	return scanner.Err()
+}
+
+// Returns the size of all the regular files in path
+func sizeOfPath(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// Lists the trashed files in trashDir, topDir is used for relative paths and is empty for the home trash
+func ListTrash(trashDir, topDir string) ([]TrashedFile, error) {
+	entries, err := os.ReadDir(filepath.Join(trashDir, "info"))
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []TrashedFile
+	for _, entry := range entries {
+		name, found := strings.CutSuffix(entry.Name(), ".trashinfo")
+		if !found {
+			continue
+		}
+
+		trashed := TrashedFile{trashDir: trashDir, name: name}
+		if readTrashInfo(&trashed, topDir) != nil {
+			continue
+		}
+
+		info, err := os.Lstat(trashed.FilesPath())
+		if err != nil {
+			continue
+		}
+
+		trashed.isDir = info.IsDir()
+		trashed.sizeBytes = sizeOfPath(trashed.FilesPath())
+		ret = append(ret, trashed)
+	}
+
+	return ret, nil
+}
+
+// Moves the trashed file back to where it was, creating the parent folders if needed
+func RestoreFromTrash(trashed TrashedFile) error {
+	if _, err := os.Lstat(trashed.originalPath); err == nil {
+		return errors.New(trashed.originalPath + " already exists")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(trashed.originalPath), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(trashed.FilesPath(), trashed.originalPath); err != nil {
+		return err
+	}
+
+	return os.Remove(trashed.InfoPath())
+}
+
+// Permanently deletes the trashed file
+func PurgeFromTrash(trashed TrashedFile) error {
+	if err := os.RemoveAll(trashed.FilesPath()); err != nil {
+		return err
+	}
+
+	return os.Remove(trashed.InfoPath())
+}
+
+// Reads the home trash and the trash of every folder in topDirs, biggest first
+func ReadTrash(topDirs []string) []TrashedFile {
+	var ret []TrashedFile
+
+	homeTrash, err := HomeTrashDir()
+	if err == nil {
+		trashed, _ := ListTrash(homeTrash, "")
+		ret = append(ret, trashed...)
+	}
+
+	for _, topDir := range topDirs {
+		mountTrash := filepath.Join(topDir, ".Trash-"+strconv.Itoa(os.Getuid()))
+		if mountTrash != homeTrash {
+			trashed, _ := ListTrash(mountTrash, topDir)
+			ret = append(ret, trashed...)
+		}
+	}
+
+	slices.SortStableFunc(ret, func(a, b TrashedFile) int {
+		if a.sizeBytes < b.sizeBytes {
+			return 1
+		} else if a.sizeBytes > b.sizeBytes {
+			return -1
+		}
+
+		return 0
+	})
+	return ret
+}
+
+// Reads the home trash and the trash of every mounted filesystem into fssize.trashed in the background, since the size of every trashed folder has to be counted
+// Expects the mutex to be locked
+func (fssize *FSSize) LoadTrash() {
+	fssize.trashLoads++
+	load := fssize.trashLoads
+	fssize.loadingTrash = true
+
+	topDirs := []string{}
+	for _, mount := range fssize.allMounts {
+		topDirs = append(topDirs, mount.mountPoint)
+	}
+	rootFolderPath := fssize.rootFolderPath
+
+	go func() {
+		if topDir, err := MountTopDir(rootFolderPath); err == nil && !slices.Contains(topDirs, topDir) {
+			topDirs = append(topDirs, topDir)
+		}
+		trashed := ReadTrash(topDirs)
+
+		fssize.mutex.Lock()
+		// Only the last one started is kept, an older one might have read the trash before something was moved to it
+		if load == fssize.trashLoads {
+			fssize.trashed = trashed
+			fssize.loadingTrash = false
+		}
+		fssize.mutex.Unlock()
+		fssize.NotifyChanged()
+	}()
+}
+
+func (fssize *FSSize) SelectedTrashedFile() (TrashedFile, bool) {
+	selected := fssize.selected[Trash]
+	if fssize.currentTab != Trash || selected >= len(fssize.trashed) {
+		return TrashedFile{}, false
+	}
+
+	return fssize.trashed[selected], true
+}
+
+// Moves the selected file in the Trash tab back to where it was
+func (fssize *FSSize) RestoreSelected() {
+	trashed, ok := fssize.SelectedTrashedFile()
+	if !ok {
+		return
+	}
+
+	fssize.ShowDialog("Restore "+trashed.originalPath+"?", []string{"Cancel", "Restore"}, func(label string) {
+		if label != "Restore" {
+			return
+		}
+
+		if err := RestoreFromTrash(trashed); err != nil {
+			fssize.ShowErrors([]string{err.Error()}, 1)
+		}
+		fssize.LoadTrash()
+	})
+}
+
+// Asks for confirmation before permanently deleting the selected file in the Trash tab
+func (fssize *FSSize) ConfirmPurge() {
+	trashed, ok := fssize.SelectedTrashedFile()
+	if !ok {
+		return
+	}
+
+	text := "Permanently delete " + trashed.originalPath + " from the trash?\n\nThis will free up " + fssize.FormatBytes(trashed.sizeBytes) + " (" + strconv.FormatInt(trashed.sizeBytes, 10) + " bytes)"
+	fssize.ShowDialog(text, []string{"Cancel", "Delete"}, func(label string) {
+		if label != "Delete" {
+			return
+		}
+
+		if err := PurgeFromTrash(trashed); err != nil {
+			fssize.ShowErrors([]string{err.Error()}, 1)
+		}
+		fssize.LoadTrash()
+	})
+}
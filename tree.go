@@ -0,0 +1,258 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// A folder or regular file in the scanned directory tree
+type Node struct {
+	name      string // The root node has the full path of the scanned folder as its name
+	parent    *Node
+	children  []*Node // Always empty for files
+	isDir     bool
+	ownSize   int64 // For folders, the sum of the regular files directly inside it. For files, the filesize
+	totalSize int64 // For folders, the cumulative size of the entire subtree (like du). For files, the filesize
+
+	// ownSize and totalSize are one of these depending on --disk-usage, these are cumulative like totalSize
+	apparentSize  int64
+	allocatedSize int64
+
+	notRead    bool // Only used for folders, the folder or some of the files in it couldn't be read, or the search was cancelled before reading it
+	incomplete bool // Only used for folders, this or a folder inside it is notRead, so the totalSize is less than it should be
+
+	mtime  int64 // Unix times in seconds
+	atime  int64
+	ctime  int64
+	uid    uint32
+	device uint64
+	inode  uint64
+
+	archive bool // A tar or zip file with --archives, the files inside it are its children
+	virtual bool // Inside an archive, not on disk
+
+	hidden        bool // Files not matching the filter, and folders without any files matching it. Not counted in the sizes of the folders above
+	duplicateLink bool // A hardlink to a file that is counted at another path, kept in the tree but not counted in the sizes of the folders above
+
+	linkCount uint64       // Only used for files, the amount of hardlinks to it
+	pending   atomic.Int32 // Only used while walking, the amount of subfolders that haven't been fully read yet
+}
+
+func (node *Node) Path() string {
+	if node.parent == nil {
+		return node.name
+	}
+
+	return filepath.Join(node.parent.Path(), node.name)
+}
+
+func (node *Node) File() File {
+	var uncompressedBytes int64
+	if node.archive {
+		for _, child := range node.children {
+			uncompressedBytes += child.apparentSize
+		}
+	}
+
+	var archivePath string
+	if node.virtual {
+		archive := node.parent
+		for archive != nil && !archive.archive {
+			archive = archive.parent
+		}
+		if archive != nil {
+			archivePath = archive.Path()
+		}
+	}
+
+	return File{
+		path:              node.Path(),
+		sizeBytes:         node.totalSize,
+		ownSizeBytes:      node.ownSize,
+		apparentBytes:     node.apparentSize,
+		allocatedBytes:    node.allocatedSize,
+		isDir:             node.isDir,
+		linkCount:         node.linkCount,
+		duplicateLink:     node.duplicateLink,
+		incomplete:        node.incomplete,
+		mtime:             node.mtime,
+		uid:               node.uid,
+		virtual:           node.virtual,
+		archive:           node.archive,
+		archivePath:       archivePath,
+		uncompressedBytes: uncompressedBytes,
+	}
+}
+
+// Fills in the times, owner and inode
+func (node *Node) SetStat(info fs.FileInfo) {
+	node.mtime = info.ModTime().Unix()
+	node.atime = node.mtime
+	node.ctime = node.mtime
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		node.atime = stat.Atim.Sec
+		node.ctime = stat.Ctim.Sec
+		node.uid = stat.Uid
+		node.device = uint64(stat.Dev)
+		node.inode = stat.Ino
+	}
+}
+
+// Sums up the sizes of all the child folders into this folder, does not recurse
+// Before this is called, apparentSize and allocatedSize should only contain the sizes of the files directly inside this folder
+func (node *Node) SumTotalSize() {
+	node.totalSize = node.ownSize
+	node.incomplete = node.notRead
+	for _, child := range node.children {
+		if child.isDir {
+			node.totalSize += child.totalSize
+			node.apparentSize += child.apparentSize
+			node.allocatedSize += child.allocatedSize
+			node.incomplete = node.incomplete || child.incomplete
+		}
+	}
+}
+
+// Calculates the sizes of this folder and every folder inside it from the files in the tree, only counting the files matching filter
+func (node *Node) RecalculateTotals(filter Filter) {
+	if !node.isDir {
+		node.hidden = !filter.Matches(node)
+
+		// The files inside archives are not filtered, and not counted in the folders above
+		for _, child := range node.children {
+			child.RecalculateTotals(NoFilter())
+		}
+		return
+	}
+
+	node.ownSize = 0
+	node.totalSize = 0
+	node.apparentSize = 0
+	node.allocatedSize = 0
+	node.incomplete = node.notRead
+	visibleChildren := false
+	for _, child := range node.children {
+		child.RecalculateTotals(filter)
+		node.incomplete = node.incomplete || child.incomplete
+		if child.hidden {
+			continue
+		}
+
+		visibleChildren = true
+		if child.duplicateLink {
+			continue
+		}
+
+		if !child.isDir {
+			node.ownSize += child.totalSize
+		}
+
+		node.totalSize += child.totalSize
+		node.apparentSize += child.apparentSize
+		node.allocatedSize += child.allocatedSize
+	}
+
+	node.hidden = filter.Active() && !visibleChildren && node.parent != nil
+}
+
+// Returns false for nodes not counted in the sizes of the folders above, because they don't match the filter or are a hardlink counted elsewhere
+func (node *Node) Counted() bool {
+	return !node.hidden && !node.duplicateLink
+}
+
+// Returns the amount of files and folders counted in the size of this node, including itself
+// The files inside archives are not counted, like their sizes
+func (node *Node) Count() (files, folders int64) {
+	if !node.Counted() {
+		return 0, 0
+	}
+
+	if !node.isDir {
+		return 1, 0
+	}
+
+	folders = 1
+	for _, child := range node.children {
+		childFiles, childFolders := child.Count()
+		files += childFiles
+		folders += childFolders
+	}
+	return files, folders
+}
+
+// Returns the child nodes sorted by totalSize, biggest first
+// Hidden children are left out
+func (node *Node) SortedChildren() []*Node {
+	ret := slices.DeleteFunc(slices.Clone(node.children), func(child *Node) bool {
+		return child.hidden
+	})
+	slices.SortFunc(ret, func(a, b *Node) int {
+		if a.totalSize < b.totalSize {
+			return 1
+		} else if a.totalSize > b.totalSize {
+			return -1
+		}
+
+		return strings.Compare(a.name, b.name)
+	})
+	return ret
+}
+
+// Returns the node at path, or nil if it is not in the tree
+func (node *Node) Find(path string) *Node {
+	relPath, err := filepath.Rel(node.Path(), path)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return nil
+	}
+
+	if relPath == "." {
+		return node
+	}
+
+	current := node
+	for _, name := range strings.Split(relPath, string(filepath.Separator)) {
+		var next *Node
+		for _, child := range current.children {
+			if child.name == name {
+				next = child
+				break
+			}
+		}
+
+		if next == nil {
+			return nil
+		}
+		current = next
+	}
+
+	return current
+}
+
+// Removes the node from its parent folder, subtracting its size from all the folders above it
+func (node *Node) Remove() {
+	if node.parent == nil {
+		return
+	}
+
+	node.parent.children = slices.DeleteFunc(node.parent.children, func(child *Node) bool {
+		return child == node
+	})
+
+	if !node.Counted() {
+		return
+	}
+
+	if !node.isDir {
+		node.parent.ownSize -= node.totalSize
+	}
+
+	for parent := node.parent; parent != nil; parent = parent.parent {
+		parent.totalSize -= node.totalSize
+		parent.apparentSize -= node.apparentSize
+		parent.allocatedSize -= node.allocatedSize
+	}
+}
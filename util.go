@@ -1,61 +1,126 @@
 package main
 
 import (
+	"errors"
+	"io/fs"
 	"math"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"unicode"
 )
 
-// Trims the last decimals up to maxDecimals, does nothing if maxDecimals is less than 0, e.g -1
-func trimLastDecimals(numberString string, maxDecimals int) string {
-	if maxDecimals < 0 {
-		return numberString
+// Returns true if path is parent or inside of it
+func IsSubPath(parent, path string) bool {
+	if path == parent {
+		return true
+	}
+
+	if !strings.HasSuffix(parent, string(filepath.Separator)) {
+		parent += string(filepath.Separator)
+	}
+	return strings.HasPrefix(path, parent)
+}
+
+// Returns the device ID of the filesystem path is on
+func deviceOf(path string) (uint64, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, errors.New("unable to get device of " + path)
 	}
+	return uint64(stat.Dev), nil
+}
+
+// Returns the amount of hardlinks to the file, or 1 if it is unknown
+func LinkCount(info fs.FileInfo) uint64 {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 1
+	}
+
+	return uint64(stat.Nlink)
+}
+
+// Returns the amount of disk space used by the file, or the apparent size if it is unknown
+func AllocatedSize(info fs.FileInfo) int64 {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.Size()
+	}
+
+	// st_blocks is always in 512-byte units, regardless of the filesystem block size
+	return stat.Blocks * 512
+}
+
+// Sparse files like VM images have much less disk space allocated than their apparent size
+func IsSparse(apparentBytes, allocatedBytes int64) bool {
+	return apparentBytes >= 1000*1000 && allocatedBytes < apparentBytes/2
+}
 
-	dotIndex := strings.Index(numberString, ".")
-	if dotIndex == -1 {
-		return numberString
+type UnitSystem int
+
+const (
+	SI       UnitSystem = iota // kB, MB, GB, ... in powers of 1000
+	IEC                        // KiB, MiB, GiB, ... in powers of 1024, like df -h
+	RawBytes                   // Always in bytes
+)
+
+var unitSystemNames = []string{"si", "iec", "raw"}
+
+func ParseUnitSystem(str string) (UnitSystem, error) {
+	for i, name := range unitSystemNames {
+		if name == str {
+			return UnitSystem(i), nil
+		}
 	}
 
-	return numberString[:min(len(numberString), dotIndex+maxDecimals+1)]
+	return SI, errors.New("Invalid --units \"" + str + "\", must be one of: " + strings.Join(unitSystemNames, ", "))
 }
 
-// If maxDecimals is less than 0, e.g -1, we show the exact size down to the byte
+// Shows bytes in the biggest unit it is at least 1 of, rounded to at most maxDecimals decimals
+// If maxDecimals is less than 0, e.g -1, we show as many decimals as needed for the exact size
 // https://en.wikipedia.org/wiki/Byte#Multiple-byte_units
-func BytesToHumanReadableUnitString(bytes uint64, maxDecimals int) string {
-	unitValues := []float64{
-		math.Pow(10, 3),
-		math.Pow(10, 6),
-		math.Pow(10, 9),
-		math.Pow(10, 12),
-		math.Pow(10, 15),
-		math.Pow(10, 18), // Largest unit that fits in 64 bits
-	}
-
-	unitStrings := []string{
-		"kB",
-		"MB",
-		"GB",
-		"TB",
-		"PB",
-		"EB",
-	}
-
-	if bytes < uint64(unitValues[0]) {
+func BytesToHumanReadableUnitString(bytes uint64, system UnitSystem, maxDecimals int) string {
+	base := float64(1000)
+	unitStrings := []string{"kB", "MB", "GB", "TB", "PB", "EB"} // EB is the largest unit that fits in 64 bits
+	if system == IEC {
+		base = 1024
+		unitStrings = []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	}
+
+	if system == RawBytes || float64(bytes) < base {
 		return strconv.FormatUint(bytes, 10) + " B"
 	}
 
-	for i, v := range unitValues {
-		if bytes >= uint64(v) {
-			continue
-		}
+	i := 0
+	value := float64(bytes) / base
+	for i < len(unitStrings)-1 && value >= base {
+		value /= base
+		i++
+	}
 
-		lastIndex := max(0, i-1)
-		return trimLastDecimals(strconv.FormatFloat(float64(bytes)/unitValues[lastIndex], 'f', -1, 64), maxDecimals) + " " + unitStrings[lastIndex]
+	if maxDecimals < 0 {
+		return strconv.FormatFloat(value, 'f', -1, 64) + " " + unitStrings[i]
+	}
+
+	// Rounding up can carry over into the next unit, 999.9996 kB should be 1 MB, not 1000 kB
+	if math.Round(value*math.Pow(10, float64(maxDecimals))) >= base*math.Pow(10, float64(maxDecimals)) && i < len(unitStrings)-1 {
+		value /= base
+		i++
 	}
 
-	return trimLastDecimals(strconv.FormatFloat(float64(bytes)/unitValues[len(unitValues)-1], 'f', -1, 64), maxDecimals) + " " + unitStrings[len(unitStrings)-1]
+	number := strconv.FormatFloat(value, 'f', maxDecimals, 64)
+	if strings.Contains(number, ".") {
+		number = strings.TrimRight(strings.TrimRight(number, "0"), ".")
+	}
+	return number + " " + unitStrings[i]
 }
 
 // Looping over the entire invisibleRunes array in isInvisible() showed up pretty high when profiling with pprof, so we generate a list of (start,end) ranges to check instead
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Uniquely identifies a file, shared by all hardlinks to it
+type Inode struct {
+	device uint64
+	inode  uint64
+}
+
+// A queue of folders waiting to be read, shared by all the walker goroutines
+type walkQueue struct {
+	mutex       sync.Mutex
+	cond        *sync.Cond
+	folders     []*Node
+	outstanding int // Folders in the queue plus the ones being read right now
+}
+
+func newWalkQueue() *walkQueue {
+	queue := &walkQueue{}
+	queue.cond = sync.NewCond(&queue.mutex)
+	return queue
+}
+
+func (queue *walkQueue) Push(folders ...*Node) {
+	queue.mutex.Lock()
+	queue.folders = append(queue.folders, folders...)
+	queue.outstanding += len(folders)
+	queue.mutex.Unlock()
+	queue.cond.Broadcast()
+}
+
+// Returns the next folder to read, or nil when every folder has been read
+func (queue *walkQueue) Pop() *Node {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for len(queue.folders) == 0 {
+		if queue.outstanding == 0 {
+			return nil
+		}
+		queue.cond.Wait()
+	}
+
+	// Last in, first out keeps the queue small, since we go deep before going wide
+	folder := queue.folders[len(queue.folders)-1]
+	queue.folders = queue.folders[:len(queue.folders)-1]
+	return folder
+}
+
+// Marks a folder returned by Pop as read
+func (queue *walkQueue) Done() {
+	queue.mutex.Lock()
+	queue.outstanding--
+	queue.mutex.Unlock()
+	queue.cond.Broadcast()
+}
+
+// Returns true if the file or folder should not be counted, or in the case of a folder, not descended into
+func (fssize *FSSize) ShouldSkip(path string, e fs.DirEntry) bool {
+	if fssize.ignoreHiddenFiles && strings.HasPrefix(e.Name(), ".") {
+		return true
+	}
+
+	if fssize.IsExcluded(path, e.IsDir()) {
+		return true
+	}
+
+	if !e.IsDir() {
+		return false
+	}
+
+	if fssize.virtualMounts == nil {
+		// Couldn't read /proc/self/mountinfo, fall back to the usual pseudo filesystem mount points
+		if path == "/dev" || path == "/proc" || path == "/sys" {
+			return true
+		}
+	} else if fssize.virtualMounts[path] {
+		return true
+	}
+
+	if path == "/home/.ecryptfs" {
+		return true
+	}
+
+	if fssize.oneFileSystem {
+		info, infoErr := e.Info()
+		if infoErr == nil {
+			stat, ok := info.Sys().(*syscall.Stat_t)
+			if ok && uint64(stat.Dev) != fssize.rootDevice {
+				fssize.mutex.Lock()
+				fssize.skippedMounts = append(fssize.skippedMounts, path)
+				fssize.mutex.Unlock()
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Reads the entries of a single folder, adding the files and folders inside it to the tree
+// Returns the subfolders, which still need to be read
+func (fssize *FSSize) readFolder(folder, top *Node) []*Node {
+	path := folder.Path()
+	fssize.stats.currentFolder.Store(&path)
+	fssize.mutex.Lock()
+	filter := fssize.filter
+	fssize.mutex.Unlock()
+
+	entries, err := os.ReadDir(path)
+	fssize.stats.folders.Add(1)
+	notRead := false
+	if err != nil {
+		fssize.AddError(path, err)
+		notRead = true
+	}
+
+	var subfolders []*Node
+	var children []*Node
+	var ownSize, apparentSize, allocatedSize int64
+	for _, entry := range entries {
+		entryPath := filepath.Join(path, entry.Name())
+		if fssize.ShouldSkip(entryPath, entry) {
+			continue
+		}
+
+		if entry.IsDir() {
+			subfolder := &Node{name: entry.Name(), parent: folder, isDir: true}
+			if info, err := entry.Info(); err == nil {
+				subfolder.SetStat(info)
+			}
+			subfolders = append(subfolders, subfolder)
+			children = append(children, subfolder)
+			continue
+		}
+
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		info, infoErr := entry.Info()
+		if infoErr != nil {
+			fssize.AddError(entryPath, infoErr)
+			notRead = true
+			continue
+		}
+
+		fssize.stats.files.Add(1)
+		fssize.stats.bytes.Add(info.Size())
+
+		size := fssize.Size(info)
+		file := &Node{name: entry.Name(), parent: folder, ownSize: size, totalSize: size, apparentSize: info.Size(), allocatedSize: AllocatedSize(info), linkCount: LinkCount(info)}
+		file.SetStat(info)
+		if fssize.archives && IsArchive(entry.Name()) {
+			if err := ReadArchive(file, entryPath, fssize.diskUsage); err != nil {
+				fssize.AddArchiveError(entryPath, err)
+				file.archive = len(file.children) > 0 // Still show what could be read from a damaged archive
+			}
+		}
+		file.RecalculateTotals(filter) // Only sets hidden, and the sizes of the folders inside an archive
+		children = append(children, file)
+
+		if file.linkCount > 1 {
+			// Which hardlink gets counted is decided by countHardlinks once every folder has been read, so the result doesn't depend on the order we read them in
+			continue
+		}
+
+		if file.hidden {
+			continue
+		}
+
+		ownSize += size
+		apparentSize += file.apparentSize
+		allocatedSize += file.allocatedSize
+
+		fssize.mutex.Lock()
+		fssize.insertTree(file)
+		fssize.mutex.Unlock()
+	}
+
+	fssize.mutex.Lock()
+	folder.children = children
+	folder.notRead = notRead
+	folder.ownSize = ownSize
+	folder.apparentSize = apparentSize
+	folder.allocatedSize = allocatedSize
+	fssize.mutex.Unlock()
+	fssize.NotifyChanged()
+
+	// The folder is finished once all of its subfolders are
+	folder.pending.Store(int32(len(subfolders)))
+	if len(subfolders) == 0 {
+		fssize.finishFolder(folder, top)
+	}
+
+	return subfolders
+}
+
+// Called once the folder and everything inside it has been read, so we know the cumulative size
+// top is the folder the walk started in, the folders above it are not waiting on anything
+func (fssize *FSSize) finishFolder(folder, top *Node) {
+	for folder != nil {
+		fssize.mutex.Lock()
+		folder.SumTotalSize()
+		fssize.InsertFile(&fssize.folders, folder.File())
+		fssize.mutex.Unlock()
+		fssize.NotifyChanged()
+
+		if folder == top {
+			return
+		}
+
+		folder = folder.parent
+		if folder.pending.Add(-1) != 0 {
+			return
+		}
+	}
+}
+
+// Walks fssize.rootFolderPath with fssize.jobs goroutines reading folders in parallel, building the tree in fssize.root
+// If folder is not nil, only that folder is read again and the rest of the tree is kept
+// The results are the same regardless of the amount of goroutines. When ctx is cancelled, the results so far are kept
+func (fssize *FSSize) Walk(ctx context.Context, folder *Node) error {
+	if folder == nil {
+		info, err := os.Lstat(fssize.rootFolderPath)
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return errors.New("not a directory: " + fssize.rootFolderPath)
+		}
+
+		folder = &Node{name: fssize.rootFolderPath, isDir: true}
+		folder.SetStat(info)
+		fssize.mutex.Lock()
+		fssize.root = folder
+		fssize.files = nil
+		fssize.folders = nil
+		fssize.diff = nil
+		fssize.scanErrors = nil
+		fssize.mutex.Unlock()
+	} else {
+		folderPath := folder.Path()
+		isInside := func(e File) bool {
+			return IsSubPath(folderPath, e.path)
+		}
+
+		fssize.mutex.Lock()
+		folder.children = nil
+		fssize.files = slices.DeleteFunc(fssize.files, isInside)
+		fssize.folders = slices.DeleteFunc(fssize.folders, isInside)
+		fssize.scanErrors = slices.DeleteFunc(fssize.scanErrors, func(e ScanError) bool {
+			return IsSubPath(folderPath, e.path)
+		})
+		fssize.mutex.Unlock()
+	}
+
+	top := folder
+	queue := newWalkQueue()
+	queue.Push(top)
+
+	var wg sync.WaitGroup
+	for range max(1, fssize.jobs) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				folder := queue.Pop()
+				if folder == nil {
+					return
+				}
+
+				// Once cancelled, the rest of the queue is emptied without reading anything
+				if ctx.Err() == nil {
+					queue.Push(fssize.readFolder(folder, top)...)
+				} else {
+					fssize.mutex.Lock()
+					folder.notRead = true
+					fssize.mutex.Unlock()
+				}
+				queue.Done()
+			}
+		}()
+	}
+	wg.Wait()
+
+	fssize.mutex.Lock()
+	defer fssize.mutex.Unlock()
+
+	fssize.countHardlinks()
+	fssize.root.RecalculateTotals(fssize.filter)
+	fssize.SortErrors()
+
+	// The lists were filled in whatever order the folders were read in, so build them again from the tree to not depend on that
+	fssize.RebuildLists()
+	return ctx.Err()
+}
+
+// Counts only one of the hardlinks to each file in the whole tree, the one with the alphabetically first path
+// The rest stay in the tree so they can still be seen in the Folders tab, but are marked as duplicateLink
+// Looking at the whole tree means a folder searched again still knows about the hardlinks outside of it
+// Expects the mutex to be locked, the sizes have to be calculated again with RecalculateTotals afterwards
+func (fssize *FSSize) countHardlinks() {
+	if fssize.root == nil {
+		return
+	}
+
+	hardlinks := make(map[Inode][]*Node)
+	collectHardlinks(fssize.root, hardlinks)
+	for _, links := range hardlinks {
+		slices.SortFunc(links, func(a, b *Node) int {
+			return strings.Compare(a.Path(), b.Path())
+		})
+
+		for i, link := range links {
+			link.duplicateLink = i > 0
+		}
+	}
+}
+
+// Adds the files inside node with more than one hardlink to hardlinks, and clears duplicateLink so countHardlinks can decide again
+func collectHardlinks(node *Node, hardlinks map[Inode][]*Node) {
+	node.duplicateLink = false
+	if !node.isDir && node.linkCount > 1 {
+		inode := Inode{device: node.device, inode: node.inode}
+		hardlinks[inode] = append(hardlinks[inode], node)
+	}
+
+	for _, child := range node.children {
+		collectHardlinks(child, hardlinks)
+	}
+}
+
+// Builds fssize.files, fssize.folders and fssize.diff again from the tree
+func (fssize *FSSize) RebuildLists() {
+	fssize.files = nil
+	fssize.folders = nil
+	fssize.insertTree(fssize.root)
+	fssize.UpdateDiff()
+}
+
+// Inserts node and everything inside it into fssize.files and fssize.folders
+func (fssize *FSSize) insertTree(node *Node) {
+	if !node.Counted() {
+		return
+	}
+
+	if !node.isDir {
+		fssize.InsertFile(&fssize.files, node.File())
+		for _, child := range node.children {
+			fssize.insertTree(child) // The files inside an archive
+		}
+		return
+	}
+
+	// The folders inside archives aren't real folders, so they're only shown when opening the archive
+	if !node.virtual {
+		fssize.InsertFile(&fssize.folders, node.File())
+	}
+	for _, child := range node.children {
+		fssize.insertTree(child)
+	}
+}
+
+// Returns the biggest files like fssize.files, but without the files inside archives
+// Built from the tree, so the files inside archives don't take the place of files on disk
+func (fssize *FSSize) FilesOnDisk() []File {
+	var files []File
+	var insert func(node *Node)
+	insert = func(node *Node) {
+		if !node.Counted() {
+			return
+		}
+
+		if !node.isDir {
+			fssize.InsertFile(&files, node.File())
+			return
+		}
+
+		for _, child := range node.children {
+			insert(child)
+		}
+	}
+
+	if fssize.root != nil {
+		insert(fssize.root)
+	}
+	return files
+}